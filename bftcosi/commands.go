@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/service"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/app"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// sign asks the roster of the group to collectively sign the given file
+// and writes the hex-encoded signature.
+func sign(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the file to sign")
+	}
+	message, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("couldn't read file to sign: %s", err)
+	}
+	roster, err := readRoster(c.String("group"))
+	if err != nil {
+		return err
+	}
+
+	client := service.NewClient()
+	response, cerr := client.SignatureRequest(roster, message, c.Int("subtrees"), c.Int("policy"))
+	if cerr != nil {
+		return fmt.Errorf("signature request failed: %s", cerr)
+	}
+
+	encoded := hex.EncodeToString(response.Signature)
+	if c.String("out") == "" {
+		fmt.Println(encoded)
+		return nil
+	}
+	return ioutil.WriteFile(c.String("out"), []byte(encoded+"\n"), 0644)
+}
+
+// verify checks the signature of the given file against the roster of the group and the policy.
+func verify(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the signed file")
+	}
+	message, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("couldn't read signed file: %s", err)
+	}
+	roster, err := readRoster(c.String("group"))
+	if err != nil {
+		return err
+	}
+	signature, err := readSignature(c.String("signature"))
+	if err != nil {
+		return err
+	}
+
+	var policy cosi.Policy = cosi.CompletePolicy{}
+	if c.Int("policy") > 0 {
+		policy = cosi.ThresholdPolicy{T: c.Int("policy")}
+	}
+
+	err = cosi.Verify(network.Suite, publics(roster), message, signature, policy)
+	if err != nil {
+		return fmt.Errorf("signature is invalid: %s", err)
+	}
+	fmt.Println("signature is valid")
+	return nil
+}
+
+// inspect decodes a signature and lists the servers of the group that signed or abstained.
+func inspect(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the signature file")
+	}
+	roster, err := readRoster(c.String("group"))
+	if err != nil {
+		return err
+	}
+	signature, err := readSignature(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	suite := network.Suite
+	lenV := suite.PointLen()
+	lenSig := lenV + suite.ScalarLen()
+	mask, err := cosi.NewMask(suite, publics(roster), nil)
+	if err != nil {
+		return err
+	}
+	if len(signature) != lenSig+mask.Len() {
+		return fmt.Errorf("signature should be %d bytes long for this roster, but is %d",
+			lenSig+mask.Len(), len(signature))
+	}
+	err = mask.SetMask(signature[lenSig:])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("V:   ", hex.EncodeToString(signature[:lenV]))
+	fmt.Println("r:   ", hex.EncodeToString(signature[lenV:lenSig]))
+	fmt.Println("mask:", hex.EncodeToString(signature[lenSig:]))
+	fmt.Printf("%d of %d servers signed\n", mask.CountEnabled(), mask.CountTotal())
+	for i, si := range roster.List {
+		enabled, err := mask.IndexEnabled(i)
+		if err != nil {
+			return err
+		}
+		status := "abstained"
+		if enabled {
+			status = "signed"
+		}
+		fmt.Printf("%4d %-10s %s\n", i, status, si.Address)
+	}
+	return nil
+}
+
+// reputation lists the reputation of the nodes kept by each server of the group,
+// from the rounds it led.
+func reputation(c *cli.Context) error {
+	roster, err := readRoster(c.String("group"))
+	if err != nil {
+		return err
+	}
+
+	client := service.NewClient()
+	for _, si := range roster.List {
+		reputations, cerr := client.Reputation(si)
+		if cerr != nil {
+			fmt.Printf("%s: couldn't get the reputations: %s\n", si.Address, cerr)
+			continue
+		}
+		fmt.Printf("%s: %d node(s)\n", si.Address, len(reputations))
+		for _, r := range reputations {
+			status := ""
+			if r.Excluded {
+				status = "excluded"
+			}
+			fmt.Printf("  %.3f signed %d, absent %d, misbehaved %d %-8s %s\n", r.Score, r.Signed,
+				r.Absent, r.Misbehaved, status, r.Server.Address)
+		}
+	}
+	return nil
+}
+
+// readRoster reads the roster from a group toml file.
+func readRoster(groupFile string) (*onet.Roster, error) {
+	f, err := os.Open(groupFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open group file: %s", err)
+	}
+	defer f.Close()
+	group, err := app.ReadGroupToml(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read group file: %s", err)
+	}
+	if group.Roster == nil || len(group.Roster.List) < 1 {
+		return nil, errors.New("the group file contains no server")
+	}
+	return group.Roster, nil
+}
+
+// readSignature reads an hex-encoded signature from a file.
+func readSignature(signatureFile string) ([]byte, error) {
+	if signatureFile == "" {
+		return nil, errors.New("no signature file given")
+	}
+	content, err := ioutil.ReadFile(signatureFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read signature file: %s", err)
+	}
+	signature, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("signature file isn't hex-encoded: %s", err)
+	}
+	return signature, nil
+}
+
+// publics returns the public keys of the roster in order.
+func publics(roster *onet.Roster) []abstract.Point {
+	list := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		list[i] = si.Public
+	}
+	return list
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	_ "github.com/dedis/student_17_bftcosi/service"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/app"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// Tests that a file signed with the sign command is accepted by the verify command,
+// and that verify fails on an altered file or an unmet policy
+func TestSignVerify(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+	nNodes := 5
+
+	_, roster, _ := local.GenTree(nNodes, true)
+	dir, err := ioutil.TempDir("", "bftcosi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	group := filepath.Join(dir, "group.toml")
+	err = writeGroup(group, roster)
+	if err != nil {
+		t.Fatal("couldn't write group file:", err)
+	}
+	file := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(file, []byte("hello world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureFile := filepath.Join(dir, "file.sig")
+
+	err = newApp().Run([]string{"bftcosi", "sign", "-g", group, "-t", "2", "-o", signatureFile, file})
+	if err != nil {
+		t.Fatal("couldn't sign the file:", err)
+	}
+	signature, err := readSignature(signatureFile)
+	if err != nil {
+		t.Fatal("couldn't read the written signature:", err)
+	}
+	err = cosi.Verify(network.Suite, publics(roster), []byte("hello world"), signature, cosi.CompletePolicy{})
+	if err != nil {
+		t.Fatal("the written signature is invalid:", err)
+	}
+
+	err = newApp().Run([]string{"bftcosi", "verify", "-g", group, "-s", signatureFile, file})
+	if err != nil {
+		t.Fatal("the signature should be valid, but verify failed:", err)
+	}
+	err = newApp().Run([]string{"bftcosi", "verify", "-g", group, "-p", "3", "-s", signatureFile, file})
+	if err != nil {
+		t.Fatal("the signature should satisfy a threshold policy, but verify failed:", err)
+	}
+
+	err = ioutil.WriteFile(file, []byte("hello world!"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newApp().Run([]string{"bftcosi", "verify", "-g", group, "-s", signatureFile, file})
+	if err == nil {
+		t.Fatal("verify should fail on an altered file, but doesn't")
+	}
+}
+
+// Tests that the commands refuse missing arguments and files
+func TestCommandErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bftcosi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+
+	for _, args := range [][]string{
+		{"bftcosi", "sign"},
+		{"bftcosi", "sign", "-g", missing, missing},
+		{"bftcosi", "verify", "-g", missing},
+		{"bftcosi", "verify", "-g", missing, "-s", missing, missing},
+		{"bftcosi", "inspect", "-g", missing, missing},
+	} {
+		if err := newApp().Run(args); err == nil {
+			t.Fatal(args[1:], "should fail, but doesn't")
+		}
+	}
+}
+
+// writeGroup writes the roster in a group toml file.
+func writeGroup(file string, roster *onet.Roster) error {
+	servers := make([]*app.ServerToml, len(roster.List))
+	for i, si := range roster.List {
+		servers[i] = app.NewServerToml(network.Suite, si.Public, si.Address)
+	}
+	return app.NewGroupToml(servers...).Save(file)
+}
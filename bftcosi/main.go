@@ -0,0 +1,108 @@
+/*
+Bftcosi is a command-line tool to request, verify and inspect collective signatures
+produced by the CoSi service.
+
+The roster is read from a group toml file as produced by the conode setup.
+Signatures are stored hex-encoded in a file, in the V || r || Z format of the cosi package.
+*/
+package main
+
+import (
+	"os"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func main() {
+	log.ErrFatal(newApp().Run(os.Args))
+}
+
+// newApp returns the command-line application with its commands and flags.
+func newApp() *cli.App {
+	cliApp := cli.NewApp()
+	cliApp.Name = "bftcosi"
+	cliApp.Usage = "request, verify and inspect collective signatures"
+	cliApp.Version = "0.1"
+	cliApp.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+
+	groupFlag := cli.StringFlag{
+		Name:  "group, g",
+		Value: "group.toml",
+		Usage: "group toml file defining the roster",
+	}
+	policyFlag := cli.IntFlag{
+		Name:  "policy, p",
+		Value: 0,
+		Usage: "minimum number of signers, 0 meaning every server of the roster",
+	}
+
+	cliApp.Commands = []cli.Command{
+		{
+			Name:      "sign",
+			Aliases:   []string{"s"},
+			Usage:     "collectively sign a file",
+			ArgsUsage: "file",
+			Action:    sign,
+			Flags: []cli.Flag{
+				groupFlag,
+				policyFlag,
+				cli.IntFlag{
+					Name:  "subtrees, t",
+					Value: 1,
+					Usage: "number of subtrees used by the protocol, 0 to let the root choose it",
+				},
+				cli.StringFlag{
+					Name:  "out, o",
+					Usage: "file where the signature is written, standard output if empty",
+				},
+			},
+		},
+		{
+			Name:      "verify",
+			Aliases:   []string{"v"},
+			Usage:     "verify a collective signature of a file",
+			ArgsUsage: "file",
+			Action:    verify,
+			Flags: []cli.Flag{
+				groupFlag,
+				policyFlag,
+				cli.StringFlag{
+					Name:  "signature, s",
+					Usage: "file containing the signature",
+				},
+			},
+		},
+		{
+			Name:      "inspect",
+			Aliases:   []string{"i"},
+			Usage:     "decode a collective signature and list its signers",
+			ArgsUsage: "signature-file",
+			Action:    inspect,
+			Flags: []cli.Flag{
+				groupFlag,
+			},
+		},
+		{
+			Name:    "reputation",
+			Aliases: []string{"r"},
+			Usage:   "list the reputation of the nodes kept by each server of the group",
+			Action:  reputation,
+			Flags: []cli.Flag{
+				groupFlag,
+			},
+		},
+	}
+
+	return cliApp
+}
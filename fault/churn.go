@@ -0,0 +1,121 @@
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Churn describes from the columns of a simulation toml file which servers are
+// crashed in each round. It is embedded in the simulation structure like Config.
+//
+// Either ChurnSchedule gives the fraction of crashed servers from some rounds on,
+// e.g. "0:0, 5:0.1, 10:0.2, 15:0", the servers crashed with a smaller fraction
+// staying crashed with a larger one. Or, without schedule, each running server
+// crashes with probability ChurnCrash before each round and each crashed server
+// recovers with probability ChurnRecover.
+//
+// The crashes only depend on the seed, so every server computes the same ones
+// without any coordination. The root, at index 0, never crashes.
+type Churn struct {
+	// ChurnSchedule is a list of round:fraction, by increasing round
+	ChurnSchedule string
+	// ChurnCrash is the probability that a running server crashes before a round
+	ChurnCrash float64
+	// ChurnRecover is the probability that a crashed server recovers before a round
+	ChurnRecover float64
+	// ChurnSeed makes the crashes reproducible
+	ChurnSeed int64
+}
+
+// churnStep is an element of a churn schedule.
+type churnStep struct {
+	round    int
+	fraction float64
+}
+
+// Enabled returns true if the configuration defines some churn.
+func (c *Churn) Enabled() bool {
+	return c.ChurnSchedule != "" || c.ChurnCrash > 0
+}
+
+// Check returns an error if the configuration is invalid.
+func (c *Churn) Check() error {
+	if c.ChurnCrash < 0 || c.ChurnCrash > 1 {
+		return fmt.Errorf("the crash probability should be between 0 and 1, but is %f", c.ChurnCrash)
+	}
+	if c.ChurnRecover < 0 || c.ChurnRecover > 1 {
+		return fmt.Errorf("the recover probability should be between 0 and 1, but is %f", c.ChurnRecover)
+	}
+	_, err := c.schedule()
+	return err
+}
+
+// Crashed returns true if the server at the given index of a roster of n servers
+// is crashed in the given round. An invalid configuration crashes no server.
+func (c *Churn) Crashed(index, n, round int) bool {
+	if index <= 0 || index >= n {
+		return false
+	}
+	steps, err := c.schedule()
+	if err != nil {
+		return false
+	}
+
+	//follow the schedule
+	if len(steps) > 0 {
+		fraction := 0.0
+		for _, step := range steps {
+			if step.round <= round {
+				fraction = step.fraction
+			}
+		}
+		order := rand.New(rand.NewSource(c.ChurnSeed)).Perm(n - 1)
+		return order[index-1] < int(fraction*float64(n-1))
+	}
+
+	//replay the random process of the server until the round
+	r := rand.New(rand.NewSource(c.ChurnSeed + int64(index)))
+	crashed := false
+	for i := 0; i <= round; i++ {
+		x := r.Float64()
+		if crashed {
+			crashed = x >= c.ChurnRecover
+		} else {
+			crashed = x < c.ChurnCrash
+		}
+	}
+	return crashed
+}
+
+// schedule parses the churn schedule.
+func (c *Churn) schedule() ([]churnStep, error) {
+	steps := make([]churnStep, 0)
+	if strings.TrimSpace(c.ChurnSchedule) == "" {
+		return steps, nil
+	}
+	for _, field := range strings.Split(c.ChurnSchedule, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid churn step \"%s\", expected round:fraction", field)
+		}
+		round, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid round in churn step \"%s\": %s", field, err)
+		}
+		fraction, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fraction in churn step \"%s\": %s", field, err)
+		}
+		if fraction < 0 || fraction > 1 {
+			return nil, fmt.Errorf("the fraction of crashed servers should be between 0 and 1, but is %f", fraction)
+		}
+		if len(steps) > 0 && round <= steps[len(steps)-1].round {
+			return nil, fmt.Errorf("the rounds of the churn schedule should be increasing, but %d follows %d",
+				round, steps[len(steps)-1].round)
+		}
+		steps = append(steps, churnStep{round, fraction})
+	}
+	return steps, nil
+}
@@ -0,0 +1,59 @@
+package fault
+
+import (
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Config describes a fault from the columns of a simulation toml file.
+// It is embedded in the simulation structure so that each row can define its fault.
+type Config struct {
+	// FaultMessage is the type name of the faulted messages, e.g. "Response"
+	FaultMessage string
+	// FaultAction is the name of the action: drop, delay, duplicate, reorder, corrupt or forgemask
+	FaultAction string
+	// FaultDelay is the delay in milliseconds of the delay action
+	FaultDelay int
+	// FaultNodes is the number of faulty nodes
+	FaultNodes int
+	// FaultOutgoing faults the messages sent by the faulty nodes instead of the received ones
+	FaultOutgoing bool
+}
+
+// Enabled returns true if the configuration defines a fault.
+func (c *Config) Enabled() bool {
+	return c.FaultAction != "" && c.FaultNodes > 0
+}
+
+// Rule returns the rule described by the configuration for the given faulty nodes.
+func (c *Config) Rule(faulty []network.ServerIdentityID) (Rule, error) {
+	action, err := ParseAction(c.FaultAction)
+	if err != nil {
+		return Rule{}, err
+	}
+	r := Rule{
+		Message: c.FaultMessage,
+		Action:  action,
+		Delay:   time.Duration(c.FaultDelay) * time.Millisecond,
+	}
+	if c.FaultOutgoing {
+		r.Senders = faulty
+	}
+	return r, nil
+}
+
+// Applies returns true if the rule of the configuration has to be installed
+// on the given server.
+func (c *Config) Applies(server *onet.Server, faulty []network.ServerIdentityID) bool {
+	if c.FaultOutgoing {
+		return true
+	}
+	for _, id := range faulty {
+		if id.Equal(server.ServerIdentity.ID) {
+			return true
+		}
+	}
+	return false
+}
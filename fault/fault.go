@@ -0,0 +1,373 @@
+/*
+Package fault injects Byzantine faults in the messages of the protocol, for the tests
+and the simulation. An Injector replaces the processor of the protocol messages of a
+server and applies its rules to the received messages before passing them to the overlay.
+
+A rule selects messages by type and sender and either drops, delays, duplicates,
+reorders, corrupts or replays them. Faults of a node's outgoing messages are obtained by
+installing the rule on every server with the node as sender, faults of its incoming
+messages by installing the rule on the node only.
+*/
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Action is the fault applied to a message
+type Action int
+
+const (
+	// Drop discards the message
+	Drop Action = iota
+	// Delay passes the message after a delay
+	Delay
+	// Duplicate passes the message twice
+	Duplicate
+	// Reorder holds the message until the next message is passed
+	Reorder
+	// Corrupt replaces the cryptographic content of the message by random values
+	Corrupt
+	// ForgeMask enables every bit of the mask of a commitment, claiming that every node committed
+	ForgeMask
+	// Replay passes the first message matched unchanged, and the content of that first
+	// message instead of each later one, as an attacker replaying an earlier round would
+	Replay
+)
+
+// DefaultReorderTimeout is the time after which a held message is passed
+// if no other message arrived.
+const DefaultReorderTimeout = time.Second
+
+var actionNames = map[string]Action{
+	"drop":      Drop,
+	"delay":     Delay,
+	"duplicate": Duplicate,
+	"reorder":   Reorder,
+	"corrupt":   Corrupt,
+	"forgemask": ForgeMask,
+	"replay":    Replay,
+}
+
+// String returns the name of the action, as used in toml files.
+func (a Action) String() string {
+	for name, action := range actionNames {
+		if action == a {
+			return name
+		}
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ParseAction returns the action of the given name, as used in toml files.
+func ParseAction(name string) (Action, error) {
+	action, ok := actionNames[strings.ToLower(name)]
+	if !ok {
+		return Drop, fmt.Errorf("unknown fault action \"%s\"", name)
+	}
+	return action, nil
+}
+
+// Rule defines which messages are faulted and how.
+type Rule struct {
+	// Message is the type name of the faulted messages (e.g. "Commitment"), any type if empty
+	Message string
+	Action  Action
+	// Delay is the delay of the Delay action
+	Delay time.Duration
+	// Senders restricts the rule to the messages of these servers, any server if empty
+	Senders []network.ServerIdentityID
+	// Skip is the number of matching messages passed before the rule applies
+	Skip int
+	// Count is the number of messages faulted, unlimited if zero
+	Count int
+}
+
+// rule is a Rule with its counter of matched messages.
+type rule struct {
+	Rule
+	matched  int
+	recorded []byte //the first message faulted by a Replay rule
+}
+
+// Injector applies the rules on the protocol messages received by a server.
+type Injector struct {
+	sync.Mutex
+	server   *onet.Server
+	overlay  *onet.Overlay
+	rules    []*rule
+	held     *network.Envelope
+	observer func(*network.Envelope, network.Message)
+	crashed  func(round int) bool
+	down     bool
+}
+
+// Install creates an injector with the given rules and installs it on the server.
+// The overlay must be the overlay of the server, it receives the passed messages.
+func Install(server *onet.Server, overlay *onet.Overlay, rules ...Rule) *Injector {
+	i := &Injector{
+		server:  server,
+		overlay: overlay,
+		rules:   make([]*rule, 0),
+	}
+	for _, r := range rules {
+		i.AddRule(r)
+	}
+	server.RegisterProcessorFunc(onet.ProtocolMsgID, i.process)
+	return i
+}
+
+// AddRule adds a rule to the injector. When several rules match a message,
+// the first one added applies, a rule still skipping messages or done with
+// its count leaving the message to the next ones.
+func (i *Injector) AddRule(r Rule) {
+	i.Lock()
+	defer i.Unlock()
+	i.rules = append(i.rules, &rule{Rule: r})
+}
+
+// Clear removes all the rules, the messages being passed unchanged.
+func (i *Injector) Clear() {
+	i.Lock()
+	defer i.Unlock()
+	i.rules = make([]*rule, 0)
+}
+
+// SetObserver sets a function called with every protocol message received,
+// before the rules are applied. It is used to take measurements on the nodes.
+func (i *Injector) SetObserver(observer func(*network.Envelope, network.Message)) {
+	i.Lock()
+	defer i.Unlock()
+	i.observer = observer
+}
+
+// SetCrashed sets a function telling whether the server is crashed in a round.
+// The round is read from the announcements: from an announcement of a round where
+// the server is crashed until one of a round where it runs, every protocol message is dropped.
+func (i *Injector) SetCrashed(crashed func(round int) bool) {
+	i.Lock()
+	defer i.Unlock()
+	i.crashed = crashed
+}
+
+// MessageName returns the name used in the rules for a message of the protocol.
+func MessageName(msg network.Message) string {
+	switch msg.(type) {
+	case *protocol.Announcement:
+		return "Announcement"
+	case *protocol.Commitment:
+		return "Commitment"
+	case *protocol.Challenge:
+		return "Challenge"
+	case *protocol.Response:
+		return "Response"
+	case *protocol.Stop:
+		return "Stop"
+	case *protocol.PublicsRequest:
+		return "PublicsRequest"
+	case *protocol.PublicsReply:
+		return "PublicsReply"
+	case *protocol.Blame:
+		return "Blame"
+	case *protocol.Ping:
+		return "Ping"
+	case *protocol.Pong:
+		return "Pong"
+	default:
+		return fmt.Sprintf("%T", msg)
+	}
+}
+
+// process is the processor function applying the rules to the received envelopes.
+func (i *Injector) process(e *network.Envelope) {
+	protocolMsg, ok := e.Msg.(*onet.ProtocolMsg)
+	if !ok {
+		i.overlay.Process(e)
+		return
+	}
+	_, msg, err := network.Unmarshal(protocolMsg.MsgSlice)
+	if err != nil {
+		log.Error("error while unmarshaling a message:", err)
+		return
+	}
+
+	i.Lock()
+	if announcement, ok := msg.(*protocol.Announcement); ok && i.crashed != nil {
+		i.down = i.crashed(announcement.Round)
+	}
+	if i.down {
+		i.Unlock()
+		log.Lvl3(i.server.Address(), "is crashed, drops", MessageName(msg))
+		return
+	}
+	observer := i.observer
+	r := i.match(e, msg)
+	held := i.held
+	i.held = nil
+	i.Unlock()
+
+	if observer != nil {
+		observer(e, msg)
+	}
+
+	if r == nil {
+		i.overlay.Process(e)
+		i.release(held)
+		return
+	}
+
+	log.Lvl3(i.server.Address(), "applies fault", r.Action, "to", MessageName(msg))
+	switch r.Action {
+	case Drop:
+	case Delay:
+		go func() {
+			time.Sleep(r.Delay)
+			i.overlay.Process(e)
+		}()
+	case Duplicate:
+		i.overlay.Process(copyEnvelope(e))
+		i.overlay.Process(e)
+	case Reorder:
+		i.Lock()
+		i.held = e
+		i.Unlock()
+		go func() {
+			time.Sleep(DefaultReorderTimeout)
+			i.Lock()
+			stillHeld := i.held == e
+			if stillHeld {
+				i.held = nil
+			}
+			i.Unlock()
+			if stillHeld {
+				i.overlay.Process(e)
+			}
+		}()
+	case Corrupt:
+		err = corrupt(protocolMsg, msg)
+		if err != nil {
+			log.Error("couldn't corrupt message:", err)
+			return
+		}
+		i.overlay.Process(e)
+	case ForgeMask:
+		err = forgeMask(protocolMsg, msg)
+		if err != nil {
+			log.Error("couldn't forge mask:", err)
+			return
+		}
+		i.overlay.Process(e)
+	case Replay:
+		i.Lock()
+		if r.recorded == nil {
+			r.recorded = append([]byte{}, protocolMsg.MsgSlice...)
+		} else {
+			protocolMsg.MsgSlice = append([]byte{}, r.recorded...)
+		}
+		i.Unlock()
+		i.overlay.Process(e)
+	}
+	i.release(held)
+}
+
+// match returns the rule applying to the message, nil if none.
+// The lock must be held.
+func (i *Injector) match(e *network.Envelope, msg network.Message) *rule {
+	for _, r := range i.rules {
+		if r.Message != "" && r.Message != MessageName(msg) {
+			continue
+		}
+		if len(r.Senders) > 0 {
+			found := false
+			for _, id := range r.Senders {
+				if id.Equal(e.ServerIdentity.ID) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		r.matched++
+		if r.matched <= r.Skip {
+			continue
+		}
+		if r.Count > 0 && r.matched > r.Skip+r.Count {
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+// release passes a message that was held for reordering.
+func (i *Injector) release(held *network.Envelope) {
+	if held != nil {
+		i.overlay.Process(held)
+	}
+}
+
+// copyEnvelope returns a copy of an envelope containing a protocol message,
+// so that it can be processed twice.
+func copyEnvelope(e *network.Envelope) *network.Envelope {
+	envelope := *e
+	protocolMsg := *e.Msg.(*onet.ProtocolMsg)
+	protocolMsg.MsgSlice = append([]byte{}, protocolMsg.MsgSlice...)
+	envelope.Msg = &protocolMsg
+	return &envelope
+}
+
+// corrupt replaces the cryptographic content of the message by random values
+// and marshals it back in the protocol message.
+func corrupt(protocolMsg *onet.ProtocolMsg, msg network.Message) error {
+	suite := network.Suite
+	switch m := msg.(type) {
+	case *protocol.Announcement:
+		if len(m.Proposal) == 0 {
+			return errors.New("empty proposal")
+		}
+		m.Proposal[0] ^= 0xFF
+	case *protocol.Commitment:
+		m.CoSiCommitment = suite.Point().Mul(nil, suite.Scalar().Pick(random.Stream))
+	case *protocol.Challenge:
+		m.CoSiChallenge = suite.Scalar().Pick(random.Stream)
+	case *protocol.Response:
+		m.CoSiReponse = suite.Scalar().Pick(random.Stream)
+	default:
+		return fmt.Errorf("cannot corrupt a message of type %T", msg)
+	}
+	buf, err := network.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	protocolMsg.MsgSlice = buf
+	return nil
+}
+
+// forgeMask enables every bit of the mask of a commitment and replaces the message.
+func forgeMask(protocolMsg *onet.ProtocolMsg, msg network.Message) error {
+	m, ok := msg.(*protocol.Commitment)
+	if !ok {
+		return fmt.Errorf("cannot forge the mask of a message of type %T", msg)
+	}
+	for i := range m.Mask {
+		m.Mask[i] = 0xFF
+	}
+	buf, err := network.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	protocolMsg.MsgSlice = buf
+	return nil
+}
@@ -0,0 +1,38 @@
+package fault
+
+import (
+	"testing"
+
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests that a message skipped by a rule, or past its count, is faulted by the next matching rule
+func TestMatchCombinedRules(t *testing.T) {
+	sender := network.NewServerIdentity(config.NewKeyPair(network.Suite).Public,
+		network.NewAddress(network.Local, "localhost:2000"))
+	other := network.NewServerIdentity(config.NewKeyPair(network.Suite).Public,
+		network.NewAddress(network.Local, "localhost:2001"))
+	i := &Injector{}
+	i.AddRule(Rule{Message: "Commitment", Action: Drop, Skip: 1, Count: 1})
+	i.AddRule(Rule{Message: "Commitment", Action: Delay, Senders: []network.ServerIdentityID{sender.ID}})
+
+	commitment := &protocol.Commitment{}
+	e := &network.Envelope{ServerIdentity: sender}
+	expected := []Action{Delay, Drop, Delay}
+	for n, action := range expected {
+		r := i.match(e, commitment)
+		if r == nil || r.Action != action {
+			t.Fatal("commitment", n, "should be faulted with", action, "but got", r)
+		}
+	}
+
+	//the second rule doesn't apply to other senders, nor to other messages
+	if r := i.match(&network.Envelope{ServerIdentity: other}, commitment); r != nil {
+		t.Fatal("no rule should apply to the commitment of another sender, but got", r.Action)
+	}
+	if r := i.match(e, &protocol.Response{}); r != nil {
+		t.Fatal("no rule should apply to a response, but got", r.Action)
+	}
+}
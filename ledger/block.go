@@ -0,0 +1,116 @@
+/*
+Package ledger defines an append-only chain of blocks, each of them collectively
+signed by the roster running the CoSi protocol and linked to the previous block by its hash.
+*/
+package ledger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Block is an element of the chain. Its hash, covering every field but the
+// signature, is collectively signed by the roster identified by RosterID.
+type Block struct {
+	Height       int
+	PreviousHash []byte
+	Payload      []byte
+	RosterID     onet.RosterID
+	Signature    []byte
+}
+
+// NewBlock creates an unsigned block following the given previous block,
+// or a genesis block if previous is nil.
+func NewBlock(previous *Block, payload []byte, roster *onet.Roster) *Block {
+	b := &Block{
+		Payload:  payload,
+		RosterID: roster.ID,
+	}
+	if previous != nil {
+		b.Height = previous.Height + 1
+		b.PreviousHash = previous.Hash()
+	}
+	return b
+}
+
+// Hash returns the hash of the block, which is the message signed by the roster.
+func (b *Block) Hash() []byte {
+	hash := sha256.New()
+	binary.Write(hash, binary.LittleEndian, int64(b.Height))
+	hash.Write(b.PreviousHash)
+	hash.Write(b.Payload)
+	rosterID := [16]byte(b.RosterID)
+	hash.Write(rosterID[:])
+	return hash.Sum(nil)
+}
+
+// Verify checks that the block is collectively signed by the given roster according to the policy.
+func (b *Block) Verify(roster *onet.Roster, policy cosi.Policy) error {
+	if roster == nil {
+		return errors.New("the roster is nil")
+	}
+	if !roster.ID.Equal(b.RosterID) {
+		return fmt.Errorf("block %d is not signed by the given roster", b.Height)
+	}
+	if b.Signature == nil {
+		return fmt.Errorf("block %d is not signed", b.Height)
+	}
+	publics := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		publics[i] = si.Public
+	}
+	err := cosi.Verify(network.Suite, publics, b.Hash(), b.Signature, policy)
+	if err != nil {
+		return fmt.Errorf("invalid signature of block %d: %s", b.Height, err)
+	}
+	return nil
+}
+
+// VerifyChain checks that the blocks are consecutive, linked by their hashes,
+// and all collectively signed by the given roster according to the policy.
+func VerifyChain(blocks []*Block, roster *onet.Roster, policy cosi.Policy) error {
+	err := verifyLinks(blocks)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		err = block.Verify(roster, policy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyLinks checks that the blocks are consecutive and linked by their hashes.
+func verifyLinks(blocks []*Block) error {
+	if len(blocks) == 0 {
+		return errors.New("no block to verify")
+	}
+	for i, block := range blocks {
+		if block == nil {
+			return fmt.Errorf("block at position %d is nil", i)
+		}
+	}
+	if blocks[0].Height == 0 && blocks[0].PreviousHash != nil {
+		return errors.New("the genesis block should have no previous hash")
+	}
+	for i := 1; i < len(blocks); i++ {
+		block, previous := blocks[i], blocks[i-1]
+		if block.Height != previous.Height+1 {
+			return fmt.Errorf("block %d follows block %d", block.Height, previous.Height)
+		}
+		if !bytes.Equal(block.PreviousHash, previous.Hash()) {
+			return fmt.Errorf("block %d is not linked to block %d", block.Height, previous.Height)
+		}
+	}
+	return nil
+}
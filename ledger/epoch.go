@@ -0,0 +1,123 @@
+package ledger
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ForwardLink starts a new epoch: the roster of the previous epoch collectively
+// signs the roster of the next one, which signs the blocks from Height on.
+// Following the links from the genesis roster, a light client can learn the
+// roster of any later epoch without having to trust the servers.
+type ForwardLink struct {
+	Height    int
+	NewRoster *onet.Roster
+	Signature []byte
+}
+
+// RosterHash returns a hash of the addresses and public keys of the roster, in order.
+func RosterHash(roster *onet.Roster) []byte {
+	hash := sha256.New()
+	for _, si := range roster.List {
+		hash.Write([]byte(si.Address))
+		si.Public.MarshalTo(hash)
+	}
+	rosterID := [16]byte(roster.ID)
+	hash.Write(rosterID[:])
+	return hash.Sum(nil)
+}
+
+// Hash returns the hash of the link, which is the message signed by the previous roster.
+func (fl *ForwardLink) Hash() []byte {
+	hash := sha256.New()
+	binary.Write(hash, binary.LittleEndian, int64(fl.Height))
+	hash.Write(RosterHash(fl.NewRoster))
+	return hash.Sum(nil)
+}
+
+// Verify checks that the link is collectively signed by the previous roster according to the policy.
+func (fl *ForwardLink) Verify(previous *onet.Roster, policy cosi.Policy) error {
+	if previous == nil || len(previous.List) < 1 {
+		return errors.New("the previous roster is empty")
+	}
+	if fl.NewRoster == nil || len(fl.NewRoster.List) < 1 {
+		return errors.New("the new roster is empty")
+	}
+	if fl.Signature == nil {
+		return errors.New("the forward link is not signed")
+	}
+	publics := make([]abstract.Point, len(previous.List))
+	for i, si := range previous.List {
+		publics[i] = si.Public
+	}
+	err := cosi.Verify(network.Suite, publics, fl.Hash(), fl.Signature, policy)
+	if err != nil {
+		return fmt.Errorf("invalid signature of forward link at height %d: %s", fl.Height, err)
+	}
+	return nil
+}
+
+// FollowForwardLinks verifies the chain of links starting from the genesis roster
+// and returns the roster of the last epoch.
+func FollowForwardLinks(genesis *onet.Roster, links []*ForwardLink, policy cosi.Policy) (*onet.Roster, error) {
+	if genesis == nil {
+		return nil, errors.New("the genesis roster is nil")
+	}
+	roster := genesis
+	height := 0
+	for i, link := range links {
+		if link == nil {
+			return nil, fmt.Errorf("forward link %d is nil", i)
+		}
+		if link.Height < height {
+			return nil, fmt.Errorf("forward link %d starts at height %d, before the previous one", i, link.Height)
+		}
+		err := link.Verify(roster, policy)
+		if err != nil {
+			return nil, err
+		}
+		roster = link.NewRoster
+		height = link.Height
+	}
+	return roster, nil
+}
+
+// RosterAt returns the roster signing the block at the given height,
+// the links being already verified.
+func RosterAt(genesis *onet.Roster, links []*ForwardLink, height int) *onet.Roster {
+	roster := genesis
+	for _, link := range links {
+		if link.Height > height {
+			break
+		}
+		roster = link.NewRoster
+	}
+	return roster
+}
+
+// VerifyEpochChain checks a chain of blocks signed by successive rosters, each
+// block being verified against the roster of its epoch.
+func VerifyEpochChain(blocks []*Block, genesis *onet.Roster, links []*ForwardLink, policy cosi.Policy) error {
+	_, err := FollowForwardLinks(genesis, links, policy)
+	if err != nil {
+		return err
+	}
+	err = verifyLinks(blocks)
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		err = block.Verify(RosterAt(genesis, links, block.Height), policy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
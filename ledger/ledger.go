@@ -0,0 +1,169 @@
+package ledger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"gopkg.in/dedis/onet.v1"
+)
+
+// Ledger stores in memory the blocks of a chain and the forward links
+// between the rosters of its epochs.
+// It is safe for concurrent use.
+type Ledger struct {
+	sync.Mutex
+	blocks  []*Block
+	genesis *onet.Roster
+	links   []*ForwardLink
+}
+
+// NewLedger returns an empty ledger.
+func NewLedger() *Ledger {
+	return &Ledger{
+		blocks: make([]*Block, 0),
+		links:  make([]*ForwardLink, 0),
+	}
+}
+
+// Append adds a block at the end of the chain, checking it follows the last block
+// and that it is signed by the roster of the current epoch.
+// The roster isn't checked as long as the genesis roster isn't set, see SetGenesis.
+// The signature is not verified, see Block.Verify.
+func (l *Ledger) Append(block *Block) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if block.Height != len(l.blocks) {
+		return fmt.Errorf("expected block at height %d, but got %d", len(l.blocks), block.Height)
+	}
+	if len(l.blocks) > 0 {
+		last := l.blocks[len(l.blocks)-1]
+		if !bytes.Equal(block.PreviousHash, last.Hash()) {
+			return fmt.Errorf("block %d is not linked to the last block", block.Height)
+		}
+	} else if block.PreviousHash != nil {
+		return fmt.Errorf("the genesis block should have no previous hash")
+	}
+	if roster := l.roster(); roster != nil && !roster.ID.Equal(block.RosterID) {
+		return fmt.Errorf("block %d is not signed by the roster of the current epoch", block.Height)
+	}
+	l.blocks = append(l.blocks, block)
+	return nil
+}
+
+// Last returns the last block of the chain, or nil if the chain is empty.
+func (l *Ledger) Last() *Block {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.blocks) == 0 {
+		return nil
+	}
+	return l.blocks[len(l.blocks)-1]
+}
+
+// Height returns the number of blocks in the chain.
+func (l *Ledger) Height() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.blocks)
+}
+
+// Range returns the blocks with heights in [start, end[.
+// The end is truncated to the height of the chain.
+func (l *Ledger) Range(start, end int) ([]*Block, error) {
+	l.Lock()
+	defer l.Unlock()
+	if end > len(l.blocks) {
+		end = len(l.blocks)
+	}
+	if start < 0 || start > end {
+		return nil, fmt.Errorf("invalid range [%d, %d[ for a chain of %d blocks", start, end, len(l.blocks))
+	}
+	blocks := make([]*Block, end-start)
+	copy(blocks, l.blocks[start:end])
+	return blocks, nil
+}
+
+// SetGenesis sets the roster of the first epoch if it isn't set yet.
+func (l *Ledger) SetGenesis(roster *onet.Roster) error {
+	l.Lock()
+	defer l.Unlock()
+	if roster == nil {
+		return errors.New("the genesis roster is nil")
+	}
+	if l.genesis != nil && !l.genesis.ID.Equal(roster.ID) {
+		return errors.New("the ledger already has another genesis roster")
+	}
+	l.genesis = roster
+	return nil
+}
+
+// Genesis returns the roster of the first epoch, nil if not set.
+func (l *Ledger) Genesis() *onet.Roster {
+	l.Lock()
+	defer l.Unlock()
+	return l.genesis
+}
+
+// Roster returns the roster of the current epoch, nil if the genesis roster isn't set.
+func (l *Ledger) Roster() *onet.Roster {
+	l.Lock()
+	defer l.Unlock()
+	return l.roster()
+}
+
+// roster returns the roster of the current epoch, the lock being held.
+func (l *Ledger) roster() *onet.Roster {
+	if len(l.links) > 0 {
+		return l.links[len(l.links)-1].NewRoster
+	}
+	return l.genesis
+}
+
+// AddForwardLink starts a new epoch at the current height.
+// The signature is not verified, see ForwardLink.Verify.
+func (l *Ledger) AddForwardLink(link *ForwardLink) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.genesis == nil {
+		return errors.New("the ledger has no genesis roster")
+	}
+	if link.Height != len(l.blocks) {
+		return fmt.Errorf("the epoch should start at height %d, but starts at %d", len(l.blocks), link.Height)
+	}
+	l.links = append(l.links, link)
+	return nil
+}
+
+// ForwardLinks returns the links between the rosters of the successive epochs.
+func (l *Ledger) ForwardLinks() []*ForwardLink {
+	l.Lock()
+	defer l.Unlock()
+	links := make([]*ForwardLink, len(l.links))
+	copy(links, l.links)
+	return links
+}
+
+// Bootstrap fills an empty ledger with the history of a chain,
+// which has to be verified beforehand, see VerifyEpochChain.
+func (l *Ledger) Bootstrap(genesis *onet.Roster, links []*ForwardLink, blocks []*Block) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.genesis != nil || len(l.blocks) > 0 {
+		return errors.New("the ledger is not empty")
+	}
+	if genesis == nil {
+		return errors.New("the genesis roster is nil")
+	}
+	for i, block := range blocks {
+		if block.Height != i {
+			return fmt.Errorf("expected block at height %d, but got %d", i, block.Height)
+		}
+	}
+	l.genesis = genesis
+	l.links = append(l.links, links...)
+	l.blocks = append(l.blocks, blocks...)
+	return nil
+}
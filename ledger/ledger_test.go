@@ -0,0 +1,63 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// Tests that the ledger only accepts linked blocks
+func TestLedgerAppend(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(3, false)
+
+	l := NewLedger()
+	genesis := NewBlock(nil, []byte("genesis"), roster)
+	if err := l.Append(genesis); err != nil {
+		t.Fatal("couldn't append genesis block:", err)
+	}
+	second := NewBlock(genesis, []byte("second"), roster)
+	if err := l.Append(second); err != nil {
+		t.Fatal("couldn't append second block:", err)
+	}
+
+	if err := l.Append(second); err == nil {
+		t.Fatal("the ledger should refuse a block at the wrong height, but doesn't")
+	}
+	unlinked := NewBlock(genesis, []byte("unlinked"), roster)
+	unlinked.Height = 2
+	if err := l.Append(unlinked); err == nil {
+		t.Fatal("the ledger should refuse a block not linked to the last one, but doesn't")
+	}
+
+	blocks, err := l.Range(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatal("expected 2 blocks, but got", len(blocks))
+	}
+	if _, err := l.Range(2, 1); err == nil {
+		t.Fatal("the ledger should refuse an invalid range, but doesn't")
+	}
+}
+
+// Tests that a chain with an unsigned block doesn't verify
+func TestVerifyChainUnsigned(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(3, false)
+
+	genesis := NewBlock(nil, []byte("genesis"), roster)
+	err := VerifyChain([]*Block{genesis}, roster, cosi.CompletePolicy{})
+	if err == nil {
+		t.Fatal("an unsigned chain should not verify, but does")
+	}
+}
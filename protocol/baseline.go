@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// TreeProtocolName is the name of the standard CoSi protocol running on any tree,
+// used as baseline to compare with the three-level trees.
+const TreeProtocolName = "TreeCoSi"
+
+func init() {
+	onet.GlobalProtocolRegister(TreeProtocolName, NewTreeProtocol)
+}
+
+// CoSiTreeNode runs the standard CoSi protocol on the whole tree it is given,
+// e.g. a star or a balanced k-ary tree. Each node waits for the commitments of its
+// children during a timeout proportional to the height of its subtree, and
+// there is no recovery of failing inner nodes.
+type CoSiTreeNode struct {
+	*onet.TreeNodeInstance
+	Proposal      []byte
+	LeavesTimeout time.Duration //time a node waits for the commitments of its leaf children
+	publics       []abstract.Point
+	stopped       chan bool //closed once by Shutdown, which can be called from any goroutine
+	stopOnce      sync.Once
+
+	FinalSignature chan []byte
+
+	ChannelAnnouncement chan StructAnnouncement
+	ChannelCommitment   chan StructCommitment
+	ChannelChallenge    chan StructChallenge
+	ChannelResponse     chan StructResponse
+}
+
+// NewTreeProtocol is used to define the baseline protocol and to register
+// the channels where the messages will be received.
+func NewTreeProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+
+	var list []abstract.Point
+	for _, t := range n.Tree().List() {
+		list = append(list, t.ServerIdentity.Public)
+	}
+
+	c := &CoSiTreeNode{
+		TreeNodeInstance: n,
+		publics:          list,
+		stopped:          make(chan bool),
+		FinalSignature:   make(chan []byte, 1),
+	}
+
+	for _, channel := range []interface{}{&c.ChannelAnnouncement, &c.ChannelCommitment, &c.ChannelChallenge, &c.ChannelResponse} {
+		err := c.RegisterChannel(channel)
+		if err != nil {
+			return nil, errors.New("couldn't register channel: " + err.Error())
+		}
+	}
+	return c, nil
+}
+
+// Shutdown stops the node, making Dispatch return at its next step.
+func (p *CoSiTreeNode) Shutdown() error {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
+	return nil
+}
+
+// Start is done only by root and starts the protocol
+func (p *CoSiTreeNode) Start() error {
+	if p.Proposal == nil {
+		return fmt.Errorf("no proposal specified")
+	}
+	if p.LeavesTimeout < 1 {
+		p.LeavesTimeout = DefaultLeavesTimeout
+	}
+	log.Lvl3("Starting tree CoSi")
+	select {
+	case p.ChannelAnnouncement <- StructAnnouncement{p.TreeNode(),
+		Announcement{p.Proposal, nil, 0, p.LeavesTimeout, 0, nil, nil}}:
+	case <-p.stopped:
+		return errors.New("protocol stopped before starting")
+	}
+	return nil
+}
+
+// Dispatch runs the four phases of the protocol on every node
+func (p *CoSiTreeNode) Dispatch() error {
+	defer p.Done()
+
+	// ----- Announcement -----
+	var announcement StructAnnouncement
+	select {
+	case announcement = <-p.ChannelAnnouncement:
+	case <-p.stopped:
+		return nil
+	}
+	p.Proposal = announcement.Proposal
+	p.LeavesTimeout = announcement.LeafTimeout
+	err := sendToChildrenInParallel(p.TreeNodeInstance, &announcement.Announcement)
+	if err != nil {
+		return err
+	}
+
+	// ----- Commitment -----
+	commitments := make([]StructCommitment, 0)
+	t := time.After(p.LeavesTimeout * time.Duration(subtreeHeight(p.TreeNode())))
+loop:
+	for range p.Children() {
+		select {
+		case commitment := <-p.ChannelCommitment:
+			commitments = append(commitments, commitment)
+		case <-t:
+			break loop
+		case <-p.stopped:
+			return nil
+		}
+	}
+	committedChildren := make([]*onet.TreeNode, 0)
+	for _, commitment := range commitments {
+		if commitment.TreeNode.Parent != p.TreeNode() {
+			return errors.New("received a Commitment from a non-Children node")
+		}
+		committedChildren = append(committedChildren, commitment.TreeNode)
+	}
+
+	secret, commitment, mask, err := generateCommitmentAndAggregate(p.TreeNodeInstance, p.publics, commitments)
+	if err != nil {
+		return err
+	}
+
+	// ----- Challenge -----
+	var challenge abstract.Scalar
+	if p.IsRoot() {
+		challenge, err = cosi.Challenge(p.Suite(), commitment, mask.AggregatePublic, p.Proposal)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = p.SendToParent(&Commitment{commitment, mask.Mask(), nil})
+		if err != nil {
+			return err
+		}
+		select {
+		case structChallenge := <-p.ChannelChallenge:
+			challenge = structChallenge.CoSiChallenge
+		case <-p.stopped:
+			return nil
+		}
+	}
+	for _, child := range committedChildren {
+		err = p.SendTo(child, &Challenge{challenge, nil})
+		if err != nil {
+			return err
+		}
+	}
+
+	// ----- Response -----
+	responses := make([]StructResponse, 0)
+	for range committedChildren {
+		select {
+		case response := <-p.ChannelResponse:
+			responses = append(responses, response)
+		case <-p.stopped:
+			return nil
+		}
+	}
+	response, err := generateResponse(p.TreeNodeInstance, responses, secret, challenge)
+	if err != nil {
+		return err
+	}
+
+	if !p.IsRoot() {
+		return p.SendToParent(&Response{response})
+	}
+	signature, err := cosi.Sign(p.Suite(), commitment, response, mask)
+	if err != nil {
+		return err
+	}
+	p.FinalSignature <- signature
+	log.Lvl3("Tree CoSi root is done without errors")
+	return nil
+}
+
+// subtreeHeight returns the number of levels below the node, at least one
+// so that leaves still wait for their (absent) children.
+func subtreeHeight(node *onet.TreeNode) int {
+	height := 0
+	for _, child := range node.Children {
+		if h := subtreeHeight(child); h > height {
+			height = h
+		}
+	}
+	return height + 1
+}
@@ -8,12 +8,23 @@ The protocol has four messages:
 	- Challenge which is sent from the root down the tree and contains the aggregated challenge
 	- Response which is sent back up to the root, containing the final aggregated signature, then used by the root to sign the proposal
 
-The protocol uses five files:
+The protocol uses sixteen files:
 - struct.go defines the messages sent around and the protocol constants
 - protocol.go defines the root node behavior
 - subprotocol.go defines non-root nodes behavior
 - gen_tree.go contains the function that generates trees
+- tree_cache.go keeps the generated trees from one round to the next
+- timeouts.go derives the timeouts of a round from the latencies observed in the previous ones
+- subtrees.go chooses the number of subtrees from the size of the tree and the measured costs
+- heartbeat.go defines the protocol pinging the nodes in the background, run by the liveness monitor of the root
+- failure_detector.go tells from the heartbeats which nodes are suspected to be dead, to leave them out of the subtrees
+- reputation.go keeps the reputation of the nodes across rounds, to avoid the failing ones as subleaders
 - helper_functions.go defines some functions that are used by both the root and the other nodes
+- leader.go defines how the leader of each round is chosen and verified
+- publics.go caches the public keys of the announcements, which only carry their hash
+- violation.go tracks the messages of the children of a node to discard the ones breaking the protocol
+- policy.go follows the commitments to know when the signing policy is met or cannot be met anymore
+- baseline.go defines the standard CoSi protocol on any tree, used as a baseline in the simulation
 
 The package protocol_tests contains unit tests testing the package's code.
 */
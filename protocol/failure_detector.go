@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// DefaultPhiThreshold is the suspicion level above which a node is considered dead.
+// A threshold of 8 means the detector is wrong about one in 10^8 times if the
+// intervals between heartbeats are normally distributed.
+const DefaultPhiThreshold = 8.0
+
+// DefaultDetectorWindow is the number of recent intervals between heartbeats kept for each node.
+const DefaultDetectorWindow = 100
+
+// FailureDetector is a phi-accrual failure detector: instead of a binary alive or dead
+// state, it gives for each node the suspicion level phi that the node is dead, from
+// the time elapsed since its last heartbeat and the distribution of the previous
+// intervals between its heartbeats. A node is suspected once phi exceeds Threshold.
+// Nodes that were never watched are never suspected.
+type FailureDetector struct {
+	Threshold float64       //DefaultPhiThreshold if not set
+	Window    int           //DefaultDetectorWindow if not set
+	MinStdDev time.Duration //lower bound of the standard deviation, a quarter of the interval if not set
+
+	sync.Mutex
+	interval time.Duration //expected interval between heartbeats, first estimate of each node
+	nodes    map[network.ServerIdentityID]*arrivals
+}
+
+// arrivals holds the heartbeats received from a node.
+type arrivals struct {
+	last      time.Time
+	intervals []time.Duration
+}
+
+// NewFailureDetector returns a detector for heartbeats sent every interval.
+func NewFailureDetector(interval time.Duration) *FailureDetector {
+	return &FailureDetector{
+		interval: interval,
+		nodes:    make(map[network.ServerIdentityID]*arrivals),
+	}
+}
+
+// Watch starts monitoring a node, as if it had sent a heartbeat at the given time,
+// so that it gets suspected if it never sends one. It does nothing if the node is watched.
+func (d *FailureDetector) Watch(id network.ServerIdentityID, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.nodes[id]; !ok {
+		d.nodes[id] = &arrivals{last: now, intervals: []time.Duration{d.interval}}
+	}
+}
+
+// Heartbeat records a heartbeat of a node received at the given time.
+func (d *FailureDetector) Heartbeat(id network.ServerIdentityID, at time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	node, ok := d.nodes[id]
+	if !ok {
+		d.nodes[id] = &arrivals{last: at, intervals: []time.Duration{d.interval}}
+		return
+	}
+	if !at.After(node.last) {
+		return
+	}
+	window := d.Window
+	if window < 1 {
+		window = DefaultDetectorWindow
+	}
+	node.intervals = append(node.intervals, at.Sub(node.last))
+	if len(node.intervals) > window {
+		node.intervals = node.intervals[len(node.intervals)-window:]
+	}
+	node.last = at
+}
+
+// Phi returns the suspicion level of a node at the given time, zero if it is not watched.
+func (d *FailureDetector) Phi(id network.ServerIdentityID, now time.Time) float64 {
+	d.Lock()
+	defer d.Unlock()
+	node, ok := d.nodes[id]
+	if !ok {
+		return 0
+	}
+
+	var mean, variance float64
+	for _, interval := range node.intervals {
+		mean += float64(interval)
+	}
+	mean /= float64(len(node.intervals))
+	for _, interval := range node.intervals {
+		variance += (float64(interval) - mean) * (float64(interval) - mean)
+	}
+	stdDev := math.Sqrt(variance / float64(len(node.intervals)))
+	minStdDev := float64(d.MinStdDev)
+	if minStdDev <= 0 {
+		minStdDev = float64(d.interval) / 4
+	}
+	if stdDev < minStdDev {
+		stdDev = minStdDev
+	}
+
+	//probability that the next heartbeat arrives even later, with normally distributed intervals
+	elapsed := float64(now.Sub(node.last))
+	later := 0.5 * math.Erfc((elapsed-mean)/(stdDev*math.Sqrt2))
+	return -math.Log10(later)
+}
+
+// Suspected returns true if the node is currently suspected to be dead.
+func (d *FailureDetector) Suspected(id network.ServerIdentityID) bool {
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = DefaultPhiThreshold
+	}
+	return d.Phi(id, time.Now()) > threshold
+}
+
+// Alive returns the first nNodes servers of the roster without the suspected ones,
+// or the roster itself if none is suspected. The first server, root of the trees, is always kept.
+func (d *FailureDetector) Alive(roster *onet.Roster, nNodes int) *onet.Roster {
+	if nNodes > len(roster.List) {
+		nNodes = len(roster.List)
+	}
+	if nNodes < 1 {
+		return roster
+	}
+	servers := []*network.ServerIdentity{roster.List[0]}
+	for _, server := range roster.List[1:nNodes] {
+		if !d.Suspected(server.ID) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == nNodes { //nobody suspected, keeps the roster of the cached trees
+		return roster
+	}
+	return onet.NewRoster(servers)
+}
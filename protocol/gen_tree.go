@@ -11,7 +11,9 @@ import (
 // Each generated subtree will have the same root.
 // Each generated tree have a root with one child (the subleader)
 // and all other nodes in the tree will be the subleader children.
-// NOTE: register being not implementable with the current API could hurt the scalability tests
+// The trees cannot be registered with the nodes in advance with the current API,
+// they are shipped to each node the first time it is used. TreeCache reuses them
+// from one round to the next so that it happens only once.
 func GenTrees(roster *onet.Roster, nNodes, nSubtrees int) ([]*onet.Tree, error) {
 
 	//parameter verification
@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// HeartbeatProtocolName is the name of the protocol pinging the nodes of a roster once.
+const HeartbeatProtocolName = "CoSiHeartbeat"
+
+// DefaultHeartbeatInterval is the time between two pings of the liveness monitor.
+const DefaultHeartbeatInterval = time.Second
+
+func init() {
+	onet.GlobalProtocolRegister(HeartbeatProtocolName, NewHeartbeatProtocol)
+}
+
+// HeartbeatNode runs one ping on a star tree: the root pings every node and
+// records the pongs received before the timeout as heartbeats in its detector.
+type HeartbeatNode struct {
+	*onet.TreeNodeInstance
+	Detector *FailureDetector
+	Timeout  time.Duration //time the root waits for the pongs
+	Seq      int
+	start    chan bool //buffered, so that Start never blocks
+	stopped  chan bool //closed once by Shutdown, which can be called from any goroutine
+	stopOnce sync.Once
+
+	ChannelPing chan StructPing
+	ChannelPong chan StructPong
+}
+
+// NewHeartbeatProtocol is used to define the heartbeat protocol and to register
+// the channels where the messages will be received.
+func NewHeartbeatProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	c := &HeartbeatNode{
+		TreeNodeInstance: n,
+		start:            make(chan bool, 1),
+		stopped:          make(chan bool),
+	}
+	for _, channel := range []interface{}{&c.ChannelPing, &c.ChannelPong} {
+		err := c.RegisterChannel(channel)
+		if err != nil {
+			return nil, errors.New("couldn't register channel: " + err.Error())
+		}
+	}
+	return c, nil
+}
+
+// Shutdown stops the node, making Dispatch return at its next step.
+func (p *HeartbeatNode) Shutdown() error {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
+	return nil
+}
+
+// Start is done only by root and pings every node.
+func (p *HeartbeatNode) Start() error {
+	if p.Detector == nil {
+		return fmt.Errorf("no failure detector specified")
+	}
+	if p.Timeout < 1 {
+		p.Timeout = DefaultHeartbeatInterval
+	}
+	err := sendToChildrenInParallel(p.TreeNodeInstance, &Ping{p.Seq})
+	if err != nil {
+		log.Lvl3("couldn't ping every node:", err) //the unreachable ones miss a heartbeat
+	}
+	p.start <- true
+	return nil
+}
+
+// Dispatch answers the ping on the nodes, and collects the pongs on the root.
+func (p *HeartbeatNode) Dispatch() error {
+	defer p.Done()
+
+	if !p.IsRoot() {
+		select {
+		case ping := <-p.ChannelPing:
+			if ping.TreeNode == nil || ping.TreeNode.ID != p.Parent().ID {
+				return nil
+			}
+			return p.SendToParent(&Pong{ping.Seq})
+		case <-p.stopped:
+			return nil
+		}
+	}
+
+	//wait for start signal, the parameters being set
+	select {
+	case <-p.start:
+	case <-p.stopped:
+		return nil
+	}
+	t := time.After(p.Timeout)
+	answered := make(map[onet.TreeNodeID]bool)
+	for len(answered) < len(p.Children()) {
+		select {
+		case pong := <-p.ChannelPong:
+			if pong.TreeNode == nil || pong.Seq != p.Seq || answered[pong.TreeNode.ID] {
+				continue
+			}
+			answered[pong.TreeNode.ID] = true
+			p.Detector.Heartbeat(pong.TreeNode.ServerIdentity.ID, time.Now())
+		case <-t:
+			log.Lvl3(len(p.Children())-len(answered), "node(s) didn't answer the ping")
+			return nil
+		case <-p.stopped:
+			return nil
+		}
+	}
+	return nil
+}
+
+// LivenessMonitor runs the heartbeat protocol from the first server of a roster
+// at a regular interval, so that the failure detector knows which nodes are dead
+// before a round starts.
+type LivenessMonitor struct {
+	Detector *FailureDetector
+	Interval time.Duration
+
+	tree           *onet.Tree //a star, generated once so that it is shipped to the nodes only once
+	createProtocol CreateProtocolFunction
+	stopped        chan bool //closed once by Stop
+	stopOnce       sync.Once
+}
+
+// NewLivenessMonitor returns a monitor pinging the servers of the roster every interval,
+// or DefaultHeartbeatInterval if not set, from the first server. createProtocol must
+// create the protocols on that server.
+func NewLivenessMonitor(roster *onet.Roster, createProtocol CreateProtocolFunction,
+	interval time.Duration) (*LivenessMonitor, error) {
+	if roster == nil || len(roster.List) < 1 {
+		return nil, errors.New("the roster is empty")
+	}
+	if createProtocol == nil {
+		return nil, errors.New("no create protocol function specified")
+	}
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	tree := roster.GenerateNaryTree(len(roster.List) - 1)
+	if tree == nil {
+		return nil, errors.New("couldn't generate the heartbeat tree")
+	}
+	return &LivenessMonitor{
+		Detector:       NewFailureDetector(interval),
+		Interval:       interval,
+		tree:           tree,
+		createProtocol: createProtocol,
+		stopped:        make(chan bool),
+	}, nil
+}
+
+// Start watches every server of the roster and pings them until Stop is called.
+func (m *LivenessMonitor) Start() {
+	now := time.Now()
+	for _, node := range m.tree.List()[1:] {
+		m.Detector.Watch(node.ServerIdentity.ID, now)
+	}
+	go func() {
+		ticker := time.NewTicker(m.Interval)
+		defer ticker.Stop()
+		for seq := 0; ; seq++ {
+			err := m.ping(seq)
+			if err != nil {
+				log.Error("couldn't start the heartbeat protocol:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-m.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops pinging the servers. It can be called multiple times.
+func (m *LivenessMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopped)
+	})
+}
+
+// ping starts one heartbeat protocol, waiting for the pongs during the interval.
+func (m *LivenessMonitor) ping(seq int) error {
+	pi, err := m.createProtocol(HeartbeatProtocolName, m.tree)
+	if err != nil {
+		return err
+	}
+	heartbeat := pi.(*HeartbeatNode)
+	heartbeat.Detector = m.Detector
+	heartbeat.Timeout = m.Interval
+	heartbeat.Seq = seq
+	return heartbeat.Start()
+}
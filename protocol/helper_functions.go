@@ -7,6 +7,7 @@ import (
 	"gopkg.in/dedis/onet.v1/log"
 	"fmt"
 	"gopkg.in/dedis/onet.v1/network"
+	"errors"
 )
 
 // generateCommitmentAndAggregate generates a personal secret and commitment
@@ -99,6 +100,105 @@ func generateResponse(t *onet.TreeNodeInstance, structResponses []StructResponse
 	return aggResponse, nil
 }
 
+// checkChildMask returns the mask of the commitment of a child, or an error if the mask
+// doesn't enable the key of the child or enables a key outside the subtree of the child.
+// The index is the one of the public keys.
+func checkChildMask(suite abstract.Suite, publics []abstract.Point, index publicsIndex, child *onet.TreeNode,
+	mask []byte) (*cosi.Mask, error) {
+	childMask, err := cosi.NewMask(suite, publics, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = childMask.SetMask(mask)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(publics); i < 8*len(mask); i++ {
+		if mask[i>>3]&(byte(1)<<uint(i&7)) != 0 {
+			return nil, errors.New("the mask enables a bit beyond the public keys")
+		}
+	}
+
+	//enable the keys of the subtree of the child
+	subtree, err := cosi.NewMask(suite, publics, nil)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []*onet.TreeNode{child}
+	for len(nodes) > 0 {
+		node := nodes[0]
+		nodes = append(nodes[1:], node.Children...)
+		i := index.of(node.ServerIdentity.Public)
+		if i < 0 {
+			return nil, fmt.Errorf("the key of %s is not in the public keys", node.ServerIdentity.Address)
+		}
+		err = subtree.SetBit(i, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	enabled, err := childMask.KeyEnabled(child.ServerIdentity.Public)
+	if err != nil {
+		return nil, err
+	} else if !enabled {
+		return nil, errors.New("the mask doesn't enable the key of the child")
+	}
+	for i := range publics {
+		inMask, _ := childMask.IndexEnabled(i)
+		inSubtree, _ := subtree.IndexEnabled(i)
+		if inMask && !inSubtree {
+			return nil, fmt.Errorf("the mask enables the key %d, outside the subtree of the child", i)
+		}
+	}
+	return childMask, nil
+}
+
+// inSubtree returns true if the node is a descendant of the root of the subtree.
+func inSubtree(node, root *onet.TreeNode) bool {
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		if parent.ID == root.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// publicsIndex maps each public key, by its string, to its index in the public keys,
+// so that finding a key doesn't compare it with every other key.
+type publicsIndex map[string]int
+
+// newPublicsIndex returns the index of the public keys.
+func newPublicsIndex(publics []abstract.Point) publicsIndex {
+	index := make(publicsIndex, len(publics))
+	for i, public := range publics {
+		index[public.String()] = i
+	}
+	return index
+}
+
+// of returns the index of the key in the public keys, -1 if it is not in them.
+func (index publicsIndex) of(key abstract.Point) int {
+	if i, ok := index[key.String()]; ok {
+		return i
+	}
+	return -1
+}
+
+// verifyChildResponse checks that the response of a child matches its aggregated commitment
+// and the keys enabled in its mask, i.e. that r*B = V + c*A. It fails if the mask enables
+// a node whose commitment the child didn't aggregate.
+func verifyChildResponse(suite abstract.Suite, commitment abstract.Point, mask *cosi.Mask,
+	challenge, response abstract.Scalar) error {
+
+	left := suite.Point().Mul(nil, response)
+	cA := suite.Point().Mul(mask.AggregatePublic, challenge)
+	right := suite.Point().Add(commitment, cA)
+	if !left.Equal(right) {
+		return errors.New("the response doesn't match the commitment and the mask")
+	}
+	return nil
+}
 
 func GetSubleaderIDs(tree *onet.Tree, nNodes, nSubtrees int) ([]network.ServerIdentityID, error) {
 	exampleTrees, err := GenTrees(tree.Roster, nNodes, nSubtrees)
@@ -131,4 +231,26 @@ func GetLeafsIDs(tree *onet.Tree, nNodes, nSubtrees int) ([]network.ServerIdenti
 		}
 	}
 	return leafsIDs, nil
-}
\ No newline at end of file
+}
+
+// sendToChildrenInParallel sends the message to every child at the same time,
+// so a large proposal doesn't reach the last child only after being sent to all the others.
+// It returns the first error encountered once every send is done.
+func sendToChildrenInParallel(t *onet.TreeNodeInstance, msg interface{}) error {
+	children := t.Children()
+	errs := make(chan error, len(children))
+	for _, child := range children {
+		go func(child *onet.TreeNode) {
+			errs <- t.SendTo(child, msg)
+		}(child)
+	}
+
+	var firstErr error
+	for range children {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// NonceSize is the size in bytes of the nonce of the announcements.
+const NonceSize = 16
+
+// LeaderVerifier is called by the nodes when receiving an announcement, with the
+// round of the announcement and the server that leads it.
+// It returns an error if that server should not lead this round.
+// As the tree, root included, is sent by the parent, a node without LeaderVerifier
+// cannot tell a subleader re-rooting the tree at itself from the leader.
+type LeaderVerifier func(round int, leader *network.ServerIdentity) error
+
+// RoundRobinLeader returns the index in the roster of the leader of a round,
+// each server of the roster leading a round in turn. The rotation doesn't depend
+// on the reputations, which every node would have to agree on.
+func RoundRobinLeader(roster *onet.Roster, round int) (int, error) {
+	if roster == nil || len(roster.List) < 1 {
+		return -1, errors.New("the roster is empty")
+	}
+	if round < 0 {
+		return -1, fmt.Errorf("the round cannot be negative, but is %d", round)
+	}
+	return round % len(roster.List), nil
+}
+
+// RosterWithLeader returns a new roster where the leader is moved in first position,
+// since the trees generated by GenTrees use the first server as root.
+func RosterWithLeader(roster *onet.Roster, leader int) (*onet.Roster, error) {
+	if roster == nil || len(roster.List) < 1 {
+		return nil, errors.New("the roster is empty")
+	}
+	if leader < 0 || leader >= len(roster.List) {
+		return nil, fmt.Errorf("the leader should be in range [0, %d], but is %d", len(roster.List)-1, leader)
+	}
+	servers := []*network.ServerIdentity{roster.List[leader]}
+	servers = append(servers, roster.List[:leader]...)
+	servers = append(servers, roster.List[leader+1:]...)
+	return onet.NewRoster(servers), nil
+}
+
+// RoundRobinVerifier returns a LeaderVerifier accepting only the round-robin leader of the roster,
+// round zero being led by the first server like any other round.
+// The key of the leader must be the one of the roster, the announcement being signed with it.
+func RoundRobinVerifier(roster *onet.Roster) LeaderVerifier {
+	return func(round int, leader *network.ServerIdentity) error {
+		expected, err := RoundRobinLeader(roster, round)
+		if err != nil {
+			return err
+		}
+		if !roster.List[expected].ID.Equal(leader.ID) || !roster.List[expected].Public.Equal(leader.Public) {
+			return fmt.Errorf("round %d should be led by %s, but is led by %s",
+				round, roster.List[expected].Address, leader.Address)
+		}
+		return nil
+	}
+}
+
+// newNonce returns a random nonce for an announcement. As the trees are reused across
+// rounds and a round can be run again, only the nonce tells two announcements apart.
+func newNonce() []byte {
+	return random.Bytes(NonceSize, random.Stream)
+}
+
+// announcementMessage returns the content of an announcement signed by the leader:
+// the hash of the proposal, the hash of the public keys, the tree, the round, the timeouts and the nonce.
+func announcementMessage(tree onet.TreeID, a *Announcement) []byte {
+	hash := sha256.New()
+	proposal := sha256.Sum256(a.Proposal)
+	hash.Write(proposal[:])
+	hash.Write(a.PublicsHash)
+	hash.Write([]byte(tree.String()))
+	for _, value := range []int64{int64(a.Round), int64(a.SubleaderTimeout), int64(a.LeafTimeout)} {
+		binary.Write(hash, binary.LittleEndian, value)
+	}
+	hash.Write(a.Nonce)
+	return hash.Sum(nil)
+}
+
+// challengeMessage returns the content of a challenge signed by the leader: the tree,
+// the round, the hash of the proposal, the nonce of the announcement and the challenge,
+// so that a challenge is only accepted by the nodes of the announcement it answers.
+func challengeMessage(tree onet.TreeID, round int, proposal, nonce []byte, challenge abstract.Scalar) ([]byte, error) {
+	hash := sha256.New()
+	hash.Write([]byte(tree.String()))
+	binary.Write(hash, binary.LittleEndian, int64(round))
+	proposalHash := sha256.Sum256(proposal)
+	hash.Write(proposalHash[:])
+	hash.Write(nonce)
+	if _, err := challenge.MarshalTo(hash); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// signAsLeader signs a message with the key of the leader,
+// as a collective signature of the leader alone.
+func signAsLeader(suite abstract.Suite, private abstract.Scalar, public abstract.Point, message []byte) ([]byte, error) {
+	secret, commitment := cosi.Commit(suite, nil)
+	challenge, err := cosi.Challenge(suite, commitment, public, message)
+	if err != nil {
+		return nil, err
+	}
+	response, err := cosi.Response(suite, private, secret, challenge)
+	if err != nil {
+		return nil, err
+	}
+	mask, err := cosi.NewMask(suite, []abstract.Point{public}, public)
+	if err != nil {
+		return nil, err
+	}
+	return cosi.Sign(suite, commitment, response, mask)
+}
+
+// verifyLeaderSignature checks that the message is signed by the leader with signAsLeader.
+func verifyLeaderSignature(suite abstract.Suite, public abstract.Point, message, signature []byte) error {
+	if len(signature) == 0 {
+		return errors.New("the message is not signed by the leader")
+	}
+	if len(signature) != suite.PointLen()+suite.ScalarLen()+1 {
+		return fmt.Errorf("the signature of the leader should be %d bytes long, but is %d bytes long",
+			suite.PointLen()+suite.ScalarLen()+1, len(signature))
+	}
+	err := cosi.Verify(suite, []abstract.Point{public}, message, signature, cosi.CompletePolicy{})
+	if err != nil {
+		return fmt.Errorf("invalid signature of the leader: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// policyTracker follows which nodes committed and which ones still can,
+// to tell the root when the policy is met or when it cannot be met anymore.
+type policyTracker struct {
+	policy    cosi.Policy
+	publics   []abstract.Point
+	index     publicsIndex //of the public keys, shared with the root
+	committed *cosi.Mask
+	servers   [][]*network.ServerIdentity //nodes of each subtree, without the root
+	resolved  []bool
+	failed    map[network.ServerIdentityID]bool
+	t         *onet.TreeNodeInstance
+}
+
+// newPolicyTracker creates a tracker where only the root committed.
+func newPolicyTracker(t *onet.TreeNodeInstance, policy cosi.Policy, publics []abstract.Point, index publicsIndex,
+	trees []*onet.Tree) (*policyTracker, error) {
+
+	committed, err := cosi.NewMask(t.Suite(), publics, t.Public())
+	if err != nil {
+		return nil, fmt.Errorf("error in creation of the mask of the root: %s", err)
+	}
+
+	servers := make([][]*network.ServerIdentity, len(trees))
+	for i, tree := range trees {
+		servers[i] = tree.Roster.List[1:]
+	}
+
+	return &policyTracker{
+		policy:    policy,
+		publics:   publics,
+		index:     index,
+		committed: committed,
+		servers:   servers,
+		resolved:  make([]bool, len(trees)),
+		failed:    make(map[network.ServerIdentityID]bool),
+		t:         t,
+	}, nil
+}
+
+// update takes an event of a subtree into account.
+func (pt *policyTracker) update(e subtreeEvent) error {
+	if e.failed != nil {
+		pt.failed[e.failed.ID] = true
+	}
+	if e.done {
+		pt.resolved[e.index] = true
+	}
+	if e.commitment != nil {
+		mask, err := cosi.AggregateMasks(pt.committed.Mask(), e.commitment.Mask)
+		if err != nil {
+			return err
+		}
+		return pt.committed.SetMask(mask)
+	}
+	return nil
+}
+
+// met returns true if the nodes that committed satisfy the policy.
+func (pt *policyTracker) met() bool {
+	return pt.policy.Check(pt.committed)
+}
+
+// checkAttainable returns an error if the policy cannot be met anymore,
+// even if every node of the pending subtrees commits.
+func (pt *policyTracker) checkAttainable() error {
+	possible, err := cosi.NewMask(pt.t.Suite(), pt.publics, nil)
+	if err != nil {
+		return err
+	}
+	err = possible.SetMask(pt.committed.Mask())
+	if err != nil {
+		return err
+	}
+	for i, servers := range pt.servers {
+		if pt.resolved[i] {
+			continue
+		}
+		for _, server := range servers {
+			if pt.failed[server.ID] {
+				continue
+			}
+			index, ok := pt.index[server.Public.String()]
+			if !ok {
+				return fmt.Errorf("the key of %s is not in the public keys", server.Address)
+			}
+			err = possible.SetBit(index, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !pt.policy.Check(possible) {
+		return fmt.Errorf("the policy cannot be met anymore: at most %d of %d nodes can commit",
+			possible.CountEnabled(), len(pt.publics))
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/dedis/student_17_bftcosi/cosi"
@@ -14,10 +15,11 @@ import (
 //init() is done at startup. It defines every messages that is handled by the network
 // and registers the protocols.
 func init() {
-	network.RegisterMessages(Announcement{}, Commitment{}, Challenge{}, Response{}, Stop{})
+	network.RegisterMessages(Announcement{}, Commitment{}, Challenge{}, Response{}, Stop{},
+		PublicsRequest{}, PublicsReply{}, Blame{}, Ping{}, Pong{})
 
 	onet.GlobalProtocolRegister(ProtocolName, NewProtocol)
-	onet.GlobalProtocolRegister(subProtocolName, NewSubProtocol)
+	onet.GlobalProtocolRegister(SubProtocolName, NewSubProtocol)
 }
 // CoSiRootNode holds the parameters of the protocol.
 // It also defines a channel that will receive the final signature.
@@ -30,12 +32,43 @@ type CoSiRootNode struct {
 	ProtocolTimeout			time.Duration
 	SubleaderTimeout		time.Duration
 	LeavesTimeout			time.Duration
+	Round					int //used by the nodes to check the leader
+	Publics					[]abstract.Point //if set, replaces the keys in tree order as the order of the mask
+	Policy					cosi.Policy //if set, the challenge is sent as soon as the commitments satisfy it
+	GracePeriod				time.Duration //time waited for more commitments once the policy is met
+	ViolationReporter		ViolationReporter //if set, called with every message of a subleader breaking the protocol
+	TreeCache				*TreeCache //if set, the subtrees are reused from one round to the next
+	Timeouts				*TimeoutEstimator //if set, derives the timeouts from the previous rounds once it has samples
+	CostModel				*CostModel //if set and NSubtrees is zero, chooses the number of subtrees from the previous rounds
+	FailureDetector			*FailureDetector //if set, the nodes suspected to be dead are left out of the subtrees
+	Reputation				*ReputationTable //if set, updated after the round, the nodes with a bad reputation not being subleaders
+	BackupSubleaders		bool //runs each subtree with a backup subleader too, using the first aggregate to arrive
 
 	publics 				[]abstract.Point
-	hasStopped       		bool //used since Shutdown can be called multiple time
-	start					chan bool
+	index					publicsIndex //of the public keys, built once the protocol is started
+	blames					chan Violation //from the subprotocols giving up the round, buffered
+	start					chan bool //buffered, so that Start never blocks
+	startLock				sync.Mutex
+	started					bool
+	stopped					chan bool //closed once by Shutdown, which can be called from any goroutine
+	stopOnce				sync.Once
+	outcomes				*roundOutcomes //of the nodes in this round, set with a reputation table
 
 	FinalSignature			chan []byte
+	Stats					RoundStats //filled before the signature is sent on FinalSignature
+}
+
+// RoundStats holds the duration of each phase of a run, measured by the root.
+// The announcement isn't acknowledged, so it is measured together with the commitment.
+type RoundStats struct {
+	Commitment			time.Duration //from the start of the subprotocols until every commitment is received, announcement included
+	Challenge			time.Duration //until the challenge is sent to every subprotocol
+	Response			time.Duration //until every response is received and the proposal signed
+	SubleaderRestarts	int
+	BackupCommitments	int //subtrees whose backup subleader committed first
+	NSubtrees			int //used in the round, chosen automatically if NSubtrees was zero
+	SubleaderTimeout	time.Duration //used in the round, derived from the previous rounds if adaptive
+	LeavesTimeout		time.Duration
 }
 
 type CreateProtocolFunction func(name string, t *onet.Tree) (onet.ProtocolInstance, error)
@@ -51,34 +84,67 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	c := &CoSiRootNode{
 		TreeNodeInstance: n,
 		publics:          list,
-		hasStopped:       false,
-		start:            make(chan bool),
-		FinalSignature:   make(chan []byte),
+		start:            make(chan bool, 1),
+		stopped:          make(chan bool),
+		blames:           make(chan Violation, 1),
+		FinalSignature:   make(chan []byte, 1), //buffered so that the root is done even if nobody listens
 	}
 
 	return c, nil
 }
 
 
+// Shutdown stops the root, making Dispatch return at its next step.
 func (p *CoSiRootNode) Shutdown() error {
-	if !p.hasStopped {
-		close(p.start)
-		p.hasStopped = true
-	}
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
 	return nil
 }
 
 //Dispatch() is the main method of the protocol, defining the root node behaviour
-// and sequential handling of subprotocols.
+// and handling of subprotocols.
 func (p *CoSiRootNode) Dispatch() error {
 
+	defer p.Done()
 	if !p.IsRoot() {
 		return nil
 	}
 
-	//generate trees
+	//wait for start signal
+	select {
+	case <-p.start:
+	case <-p.stopped:
+		return nil
+	}
+
+	p.index = newPublicsIndex(p.publics)
+
+	//leave out the nodes known to be dead or excluded for their reputation,
+	//so that they are neither subleaders nor waited for
 	nNodes := p.Tree().Size()
-	trees, err := GenTrees(p.Tree().Roster, nNodes, p.NSubtrees)
+	roster := p.Tree().Roster
+	if p.FailureDetector != nil {
+		roster = p.FailureDetector.Alive(roster, nNodes)
+	}
+	if p.Reputation != nil {
+		roster = p.Reputation.Allowed(roster, nNodes)
+		p.outcomes = newRoundOutcomes()
+		defer p.outcomes.recordIn(p.Reputation)
+	}
+	if len(roster.List) < nNodes {
+		log.Lvl2("leaving out", nNodes-len(roster.List), "node(s) suspected to be dead or with a bad reputation")
+		nNodes = len(roster.List)
+	}
+
+	//generate trees, or reuse the ones of the previous rounds
+	var trees []*onet.Tree
+	var err error
+	if p.TreeCache != nil {
+		trees, err = p.TreeCache.Trees(roster, nNodes, p.NSubtrees)
+	} else {
+		trees, err = GenTrees(roster, nNodes, p.NSubtrees)
+	}
 	if err != nil {
 		return fmt.Errorf("error in tree generation: %s", err)
 	}
@@ -88,81 +154,67 @@ func (p *CoSiRootNode) Dispatch() error {
 		trees = make([]*onet.Tree, 0)
 	}
 
-	//wait for start signal
-	_, channelOpen := <- p.start
-	if !channelOpen {
-		return nil
+	//avoid the subleaders with a bad reputation
+	if p.Reputation != nil {
+		for i, tree := range trees {
+			trees[i], err = p.electSubleader(tree)
+			if err != nil {
+				return fmt.Errorf("error in tree generation: %s", err)
+			}
+		}
 	}
 
-	//start all subprotocols
-	coSiSubProtocols := make([]*CoSiSubProtocolNode, len(trees))
-	for i, tree := range trees {
-		coSiSubProtocols[i], err = p.startSubProtocol(tree)
-		if err != nil {
-			return err
+	//derive the timeouts from the previous rounds, keeping the static ones until there are samples
+	if p.Timeouts != nil {
+		if subleader, leaves, ok := p.Timeouts.Timeouts(); ok {
+			p.SubleaderTimeout, p.LeavesTimeout = subleader, leaves
+			log.Lvl3("adaptive timeouts:", subleader, "for the subleaders,", leaves, "for the leaves")
 		}
 	}
-	log.Lvl3("all protocols started")
+	p.Stats.SubleaderTimeout, p.Stats.LeavesTimeout = p.SubleaderTimeout, p.LeavesTimeout
 
-	//get all commitments, restart subprotocols where subleaders do not respond
-	commitments := make([]StructCommitment, 0)
-	runningSubProtocols := make([]*CoSiSubProtocolNode, 0)
-	subtrees:
-	for i, subProtocol := range coSiSubProtocols {
-		for {
-			select {
-			case _ = <-subProtocol.subleaderNotResponding:
-				log.Lvlf2("subleader from tree %d failed, restarting it", i)
-
-				//send stop signal
-				subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
-
-				//generate new tree
-				subleaderID := trees[i].Root.Children[0].RosterIndex
-				newSubleaderID := subleaderID +1
-				if newSubleaderID >= len(trees[i].Roster.List) {
-					log.Lvl2("subprotocol", i,  "failed with every subleader, ignoring this subtree")
-					continue subtrees
-				}
-				trees[i], err = GenSubtree(trees[i].Roster, newSubleaderID)
-				if err != nil {
-					return err
-				}
+	//start all subprotocols, and the ones of the backup subleaders
+	phaseStart := time.Now()
+	coSiSubProtocols, backups, err := p.startSubProtocolsInParallel(trees)
+	if err != nil {
+		return p.abort(append(coSiSubProtocols, backups...), err)
+	}
+	log.Lvl3("all protocols started")
+	p.Stats.NSubtrees = len(trees)
 
-				//restart subprotocol
-				subProtocol, err = p.startSubProtocol(trees[i])
-				if err != nil {
-					return fmt.Errorf("error in restarting of subprotocol: %s", err)
-				}
-			case commitment := <-subProtocol.subCommitment:
-				runningSubProtocols = append(runningSubProtocols,subProtocol)
-				commitments = append(commitments, commitment)
-				continue subtrees
-			case <-time.After(p.ProtocolTimeout):
-				return fmt.Errorf("didn't get commitment in time")
-			}
-		}
+	//get the commitments, restart subprotocols where subleaders do not respond
+	runningSubProtocols, commitments, err := p.collectCommitments(trees, coSiSubProtocols, backups)
+	if err != nil {
+		return err
 	}
 
+	p.Stats.Commitment = time.Since(phaseStart)
+	phaseStart = time.Now()
+
 	//generate challenge
 	log.Lvl3("root-node generating global challenge")
 	secret, commitment, finalMask, err := generateCommitmentAndAggregate(p.TreeNodeInstance, p.publics, commitments)
 	if err != nil {
-		return err
+		return p.abort(runningSubProtocols, err)
 	}
 
 	coSiChallenge, err := cosi.Challenge(p.Suite(), commitment, finalMask.AggregatePublic, p.Proposal)
 	if err != nil {
-		return err
+		return p.abort(runningSubProtocols, err)
 	}
-	structChallenge := StructChallenge{p.TreeNode(), Challenge{coSiChallenge}}
-
-	//send challenge to every subprotocol
+	//send challenge to every subprotocol, as coming from its root
 	for _, coSiProtocol := range runningSubProtocols {
 		subProtocol := coSiProtocol
-		subProtocol.ChannelChallenge <- structChallenge
+		structChallenge := StructChallenge{subProtocol.TreeNode(), Challenge{coSiChallenge, nil}}
+		select {
+		case subProtocol.ChannelChallenge <- structChallenge:
+		case <-subProtocol.stopped: //its response will be missing
+		}
 	}
 
+	p.Stats.Challenge = time.Since(phaseStart)
+	phaseStart = time.Now()
+
 	//get response from all subprotocols
 	responses := make([]StructResponse, 0)
 	for _, cosiSubProtocol := range runningSubProtocols {
@@ -171,8 +223,12 @@ func (p *CoSiRootNode) Dispatch() error {
 		case response := <-subProtocol.subResponse:
 			responses = append(responses, response)
 			continue
+		case blame := <-p.blames:
+			return p.abort(runningSubProtocols, fmt.Errorf("a subtree gave up the round: %s", blame))
 		case <-time.After(p.ProtocolTimeout):
-			return fmt.Errorf("didn't finish in time")
+			return p.abort(runningSubProtocols, fmt.Errorf("didn't finish in time"))
+		case <-p.stopped:
+			return p.abort(runningSubProtocols, fmt.Errorf("root stopped"))
 		}
 	}
 
@@ -187,6 +243,11 @@ func (p *CoSiRootNode) Dispatch() error {
 	if err != nil {
 		return err
 	}
+	p.Stats.Response = time.Since(phaseStart)
+	if p.outcomes != nil {
+		p.recordSigners(trees, finalMask)
+		p.outcomes.recordIn(p.Reputation)
+	}
 	p.FinalSignature <- signature
 
 	log.Lvl3("Root-node is done without errors")
@@ -196,13 +257,23 @@ func (p *CoSiRootNode) Dispatch() error {
 // Start is done only by root and starts the protocol.
 // It also verifies that the protocol has been correctly parameterized.
 func (p *CoSiRootNode) Start() error {
+	p.startLock.Lock()
+	defer p.startLock.Unlock()
+	if p.started {
+		return fmt.Errorf("the protocol has already been started")
+	}
+
 	if p.Proposal == nil {
 		return fmt.Errorf("no proposal specified")
 	} else if p.CreateProtocol == nil {
 		return fmt.Errorf("no create protocol function specified")
-	} else if p.NSubtrees < 1 {
+	} else if p.NSubtrees < 0 {
 		p.NSubtrees = 1
 	}
+	if p.NSubtrees == 0 {
+		p.NSubtrees = p.autoSubtrees()
+		log.Lvl3("using", p.NSubtrees, "subtree(s)")
+	}
 	if p.ProtocolTimeout < 10 {
 		p.ProtocolTimeout = DefaultProtocolTimeout
 	}
@@ -212,17 +283,435 @@ func (p *CoSiRootNode) Start() error {
 	if p.LeavesTimeout < 10 {
 		p.LeavesTimeout = DefaultLeavesTimeout
 	}
+	if p.Round < 0 {
+		return fmt.Errorf("the round cannot be negative, but is %d", p.Round)
+	}
+	if p.Publics != nil {
+		if len(p.Publics) != len(p.publics) {
+			return fmt.Errorf("expected %d public keys, but got %d", len(p.publics), len(p.Publics))
+		}
+		p.publics = p.Publics
+	}
+
+	select {
+	case <-p.stopped:
+		return fmt.Errorf("the protocol has been stopped")
+	default:
+	}
 
 	log.Lvl3("Starting CoSi")
+	p.started = true
 	p.start <- true
 	return nil
 }
 
+// abort stops the given subprotocols, nil ones being skipped, each one propagating
+// the stop to all its nodes, and returns the error that made the root give up.
+// The subprotocols the root is still waiting for are stopped by their watcher.
+func (p *CoSiRootNode) abort(subProtocols []*CoSiSubProtocolNode, err error) error {
+	log.Lvl2("root aborts the protocol:", err)
+	for _, subProtocol := range subProtocols {
+		if subProtocol == nil {
+			continue
+		}
+		subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+	}
+	return err
+}
+
+// subtreeEvent is sent to the root by the goroutine watching a subtree.
+type subtreeEvent struct {
+	index       int
+	subProtocol *CoSiSubProtocolNode
+	commitment  *StructCommitment       //set if the subtree committed
+	failed      *network.ServerIdentity //set if a subleader didn't respond
+	fallback    bool                    //the other subleader of the group is still running, no restart
+	byBackup    bool                    //the commitment was aggregated by the backup subleader
+	done        bool                    //the subtree committed, or failed with every subleader
+	err         error
+}
+
+// collectCommitments gathers the commitments of the subtrees and returns the
+// subprotocols that committed with their commitments. Without policy, it waits
+// for every subtree. With a policy, it stops waiting once the policy is met and
+// the grace period is over, and fails as soon as the policy cannot be met anymore.
+// The backups are the subprotocols of the backup subleaders, nil if a subtree has none.
+func (p *CoSiRootNode) collectCommitments(trees []*onet.Tree, subProtocols, backups []*CoSiSubProtocolNode) (
+	[]*CoSiSubProtocolNode, []StructCommitment, error) {
+
+	var tracker *policyTracker
+	if p.Policy != nil {
+		var err error
+		tracker, err = newPolicyTracker(p.TreeNodeInstance, p.Policy, p.publics, p.index, trees)
+		if err == nil {
+			err = tracker.checkAttainable()
+		}
+		if err != nil {
+			return nil, nil, p.abort(append(subProtocols, backups...), err)
+		}
+	}
+
+	events := make(chan subtreeEvent)
+	stop := make(chan bool)
+	defer close(stop)
+	for i := range trees {
+		go p.watchSubtree(i, trees[i], subProtocols[i], backups[i], events, stop)
+	}
+
+	committed := make([]*CoSiSubProtocolNode, len(trees))
+	commitments := make([]*StructCommitment, len(trees))
+	var grace <-chan time.Time
+	timeout := time.After(p.ProtocolTimeout)
+	nResolved := 0
+
+	collect:
+	for nResolved < len(trees) {
+		select {
+		case e := <-events:
+			if e.err != nil {
+				return nil, nil, p.abort(committed, e.err)
+			}
+			if e.failed != nil && !e.fallback {
+				p.Stats.SubleaderRestarts++
+			}
+			if e.byBackup {
+				p.Stats.BackupCommitments++
+			}
+			if e.commitment != nil {
+				committed[e.index] = e.subProtocol
+				commitments[e.index] = e.commitment
+			}
+			if e.done {
+				nResolved++
+			}
+			if tracker == nil {
+				continue
+			}
+
+			err := tracker.update(e)
+			if err != nil {
+				return nil, nil, p.abort(committed, err)
+			}
+			err = tracker.checkAttainable()
+			if err != nil {
+				return nil, nil, p.abort(committed, err)
+			}
+			if grace == nil && tracker.met() {
+				if p.GracePeriod <= 0 {
+					break collect
+				}
+				log.Lvl3("policy met, waiting", p.GracePeriod, "for more commitments")
+				grace = time.After(p.GracePeriod)
+			}
+		case <-grace:
+			break collect
+		case <-timeout:
+			return nil, nil, p.abort(committed, fmt.Errorf("didn't get commitment in time"))
+		case <-p.stopped:
+			return nil, nil, p.abort(committed, fmt.Errorf("root stopped"))
+		}
+	}
+	if nResolved < len(trees) {
+		log.Lvl2("policy met, proceeding without", len(trees)-nResolved, "subtree(s)")
+	}
+
+	runningSubProtocols := make([]*CoSiSubProtocolNode, 0)
+	structCommitments := make([]StructCommitment, 0)
+	for i := range trees {
+		if committed[i] != nil {
+			runningSubProtocols = append(runningSubProtocols, committed[i])
+			structCommitments = append(structCommitments, *commitments[i])
+		}
+	}
+	return runningSubProtocols, structCommitments, nil
+}
+
+// watchSubtree waits for the commitment of a subtree, restarting the subprotocol
+// with the next subleader when the subleader does not respond, and reports every
+// event to the root. It stops the subprotocol if the root stops listening.
+// With a backup subprotocol, the first commitment of the two is used and the other
+// subprotocol stopped, and the subtree is only restarted once both subleaders failed.
+func (p *CoSiRootNode) watchSubtree(i int, tree *onet.Tree, subProtocol, backup *CoSiSubProtocolNode,
+	events chan<- subtreeEvent, stop <-chan bool) {
+
+	report := func(e subtreeEvent) bool {
+		select {
+		case events <- e:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	stopBackup := func() {
+		if backup != nil {
+			backup.HandleStop(StructStop{backup.TreeNode(), Stop{}})
+			backup = nil
+		}
+	}
+	failed := make(map[int]bool) //roster indexes of the subleaders that failed, skipped at restart
+
+	for {
+		//nil channels without backup, never selected
+		var backupFailed <-chan bool
+		var backupCommitment <-chan StructCommitment
+		if backup != nil {
+			backupFailed, backupCommitment = backup.subleaderNotResponding, backup.subCommitment
+		}
+
+		select {
+		case <-backupFailed:
+			log.Lvlf2("backup subleader from tree %d failed", i)
+			backupSubleader := backup.Tree().Root.Children[0]
+			p.recordOutcome(backupSubleader.ServerIdentity, Absent)
+			failed[backupSubleader.RosterIndex] = true
+			stopBackup()
+			if !report(subtreeEvent{index: i, failed: backupSubleader.ServerIdentity, fallback: true}) {
+				subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+				return
+			}
+		case commitment := <-backupCommitment:
+			log.Lvlf3("backup subleader from tree %d committed first", i)
+			subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+			subProtocol, backup = backup, nil
+			p.observeLatencies(subProtocol, commitment)
+			if !report(subtreeEvent{index: i, subProtocol: subProtocol, commitment: &commitment, byBackup: true,
+				done: true}) {
+				subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+			}
+			return
+		case _ = <-subProtocol.subleaderNotResponding:
+			if backup != nil {
+				log.Lvlf2("subleader from tree %d failed, going on with the backup subleader", i)
+				subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+				subleader := tree.Root.Children[0]
+				p.recordOutcome(subleader.ServerIdentity, Absent)
+				failed[subleader.RosterIndex] = true
+				if p.TreeCache != nil {
+					p.TreeCache.Replace(tree, backup.Tree())
+				}
+				tree, subProtocol, backup = backup.Tree(), backup, nil
+				if !report(subtreeEvent{index: i, failed: subleader.ServerIdentity, fallback: true}) {
+					subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+					return
+				}
+				continue
+			}
+			log.Lvlf2("subleader from tree %d failed, restarting it", i)
+
+			//send stop signal
+			subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+
+			//generate new tree, skipping the nodes that cannot lead
+			subleader := tree.Root.Children[0]
+			p.recordOutcome(subleader.ServerIdentity, Absent)
+			newSubleaderID := subleader.RosterIndex + 1
+			for newSubleaderID < len(tree.Roster.List) && (failed[newSubleaderID] ||
+				!p.canLead(tree.Roster.List[newSubleaderID])) {
+				newSubleaderID++
+			}
+			if newSubleaderID >= len(tree.Roster.List) {
+				log.Lvl2("subprotocol", i, "failed with every subleader, ignoring this subtree")
+				if p.TreeCache != nil {
+					p.TreeCache.Remove(tree)
+				}
+				report(subtreeEvent{index: i, failed: subleader.ServerIdentity, done: true})
+				return
+			}
+			newTree, err := GenSubtree(tree.Roster, newSubleaderID)
+			if err != nil {
+				report(subtreeEvent{index: i, err: err})
+				return
+			}
+			if p.TreeCache != nil {
+				p.TreeCache.Replace(tree, newTree)
+			}
+			tree = newTree
+
+			//restart subprotocol
+			subProtocol, err = p.startSubProtocol(tree)
+			if err != nil {
+				report(subtreeEvent{index: i, err: fmt.Errorf("error in restarting of subprotocol: %s", err)})
+				return
+			}
+			if !report(subtreeEvent{index: i, failed: subleader.ServerIdentity}) {
+				subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+				return
+			}
+		case commitment := <-subProtocol.subCommitment:
+			stopBackup()
+			p.observeLatencies(subProtocol, commitment)
+			if !report(subtreeEvent{index: i, subProtocol: subProtocol, commitment: &commitment, done: true}) {
+				subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+			}
+			return
+		case <-stop:
+			stopBackup()
+			subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+			return
+		}
+	}
+}
+
+// observeLatencies records the times observed in the commitment of a subtree,
+// for the adaptive timeouts and the choice of the number of subtrees.
+// The round-trip of the subtree beyond the one of its slowest leaf is the cost of the subtree at the root.
+func (p *CoSiRootNode) observeLatencies(subProtocol *CoSiSubProtocolNode, commitment StructCommitment) {
+	subtreeRTT := time.Since(subProtocol.started)
+	if p.Timeouts != nil {
+		subleader := subProtocol.Tree().Root.Children[0]
+		p.Timeouts.ObserveSubtree(subleader.ServerIdentity.Public, subtreeRTT)
+	}
+	var slowest time.Duration
+	for _, latency := range commitment.Latencies {
+		if latency.Index < 0 || latency.Index >= len(p.publics) {
+			continue
+		}
+		if latency.RTT > slowest {
+			slowest = latency.RTT
+		}
+		if p.Timeouts != nil {
+			p.Timeouts.ObserveLeaf(p.publics[latency.Index], latency.RTT)
+		}
+		if p.CostModel != nil {
+			p.CostModel.ObserveRTT(latency.RTT)
+		}
+	}
+	if p.CostModel != nil && subtreeRTT > slowest {
+		p.CostModel.ObserveFanout(subtreeRTT - slowest)
+	}
+}
+
+// autoSubtrees returns the number of subtrees chosen by the cost model,
+// or by the default costs without model.
+func (p *CoSiRootNode) autoSubtrees() int {
+	nNodes := p.Tree().Size()
+	if p.CostModel != nil {
+		return p.CostModel.Subtrees(nNodes)
+	}
+	return AutoSubtrees(nNodes, DefaultFanoutCost, DefaultRTT)
+}
+
+// canLead returns true if the server is neither suspected to be dead nor has a bad reputation.
+func (p *CoSiRootNode) canLead(server *network.ServerIdentity) bool {
+	if p.FailureDetector != nil && p.FailureDetector.Suspected(server.ID) {
+		return false
+	}
+	return p.Reputation == nil || p.Reputation.CanLead(server.ID)
+}
+
+// electSubleader returns the tree with the first node of its roster that can lead as
+// subleader, if its subleader cannot, the tree cache following the replacement.
+// The tree is kept if no node can lead.
+func (p *CoSiRootNode) electSubleader(tree *onet.Tree) (*onet.Tree, error) {
+	if len(tree.Root.Children) == 0 || p.canLead(tree.Root.Children[0].ServerIdentity) {
+		return tree, nil
+	}
+	for i := 1; i < len(tree.Roster.List); i++ {
+		if !p.canLead(tree.Roster.List[i]) {
+			continue
+		}
+		newTree, err := GenSubtree(tree.Roster, i)
+		if err != nil {
+			return nil, err
+		}
+		if p.TreeCache != nil {
+			p.TreeCache.Replace(tree, newTree)
+		}
+		return newTree, nil
+	}
+	return tree, nil
+}
+
+// startBackup starts the subprotocol of the backup subleader of a tree, the first node
+// of its roster after the subleader that can lead. It returns nil if the tree has no such node.
+func (p *CoSiRootNode) startBackup(tree *onet.Tree) (*CoSiSubProtocolNode, error) {
+	if len(tree.Root.Children) == 0 {
+		return nil, nil
+	}
+	subleader := tree.Root.Children[0].RosterIndex
+	for j := 1; j < len(tree.Roster.List); j++ {
+		index := (subleader+j-1)%(len(tree.Roster.List)-1) + 1
+		if index == subleader || !p.canLead(tree.Roster.List[index]) {
+			continue
+		}
+		var backupTree *onet.Tree
+		var err error
+		if p.TreeCache != nil {
+			backupTree, err = p.TreeCache.Backup(tree, index)
+		} else {
+			backupTree, err = GenSubtree(tree.Roster, index)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return p.startSubProtocol(backupTree)
+	}
+	return nil, nil
+}
+
+// recordOutcome records the outcome of a node in the round, if the root keeps reputations.
+func (p *CoSiRootNode) recordOutcome(server *network.ServerIdentity, outcome Outcome) {
+	if p.outcomes != nil {
+		p.outcomes.set(server, outcome)
+	}
+}
+
+// recordSigners records the nodes of the subtrees in the final mask as signers,
+// and the other ones as absent.
+func (p *CoSiRootNode) recordSigners(trees []*onet.Tree, finalMask *cosi.Mask) {
+	for _, tree := range trees {
+		for _, server := range tree.Roster.List[1:] {
+			outcome := Absent
+			if enabled, err := finalMask.IndexEnabled(p.index.of(server.Public)); err == nil && enabled {
+				outcome = Signed
+			}
+			p.recordOutcome(server, outcome)
+		}
+	}
+}
+
+// reportViolation records the misbehavior of the sender and forwards the violation to the reporter.
+func (p *CoSiRootNode) reportViolation(violation Violation) {
+	p.recordOutcome(violation.Sender, Misbehaved)
+	if p.ViolationReporter != nil {
+		p.ViolationReporter(violation)
+	}
+}
+
+// startSubProtocolsInParallel starts the subprotocols of all trees at the same time, and
+// the ones of their backup subleaders, so the announcement doesn't reach the last subtree
+// only after all the others. It returns the started subprotocols, nil where none is
+// started, with the first error encountered once every start is done.
+func (p *CoSiRootNode) startSubProtocolsInParallel(trees []*onet.Tree) ([]*CoSiSubProtocolNode, []*CoSiSubProtocolNode, error) {
+	subProtocols := make([]*CoSiSubProtocolNode, len(trees))
+	backups := make([]*CoSiSubProtocolNode, len(trees))
+	errs := make(chan error, len(trees))
+	for i, tree := range trees {
+		go func(i int, tree *onet.Tree) {
+			var err error
+			subProtocols[i], err = p.startSubProtocol(tree)
+			if err == nil && p.BackupSubleaders {
+				backups[i], err = p.startBackup(tree)
+			}
+			errs <- err
+		}(i, tree)
+	}
+
+	var firstErr error
+	for range trees {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return subProtocols, backups, firstErr
+}
+
 // startSubProtocol creates, parametrize and starts a subprotocol on a given tree
 // and returns the started protocol.
 func (p *CoSiRootNode) startSubProtocol (tree *onet.Tree) (*CoSiSubProtocolNode, error) {
 
-	pi, err := p.CreateProtocol(subProtocolName, tree)
+	pi, err := p.CreateProtocol(SubProtocolName, tree)
 	if err != nil {
 		return nil, err
 	}
@@ -232,6 +721,10 @@ func (p *CoSiRootNode) startSubProtocol (tree *onet.Tree) (*CoSiSubProtocolNode,
 	coSiSubProtocol.Proposal = p.Proposal
 	coSiSubProtocol.SubleaderTimeout = p.SubleaderTimeout
 	coSiSubProtocol.LeavesTimeout = p.LeavesTimeout
+	coSiSubProtocol.Round = p.Round
+	coSiSubProtocol.ViolationReporter = p.reportViolation
+	coSiSubProtocol.index = p.index
+	coSiSubProtocol.blames = p.blames
 
 	err = coSiSubProtocol.Start()
 	if err != nil {
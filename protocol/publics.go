@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// DefaultPublicsCacheSize is the number of lists of public keys kept by each server.
+const DefaultPublicsCacheSize = 16
+
+// PublicsCache holds the lists of public keys of the last announcements, by their hash,
+// so that an announcement only carries the hash of the list. The oldest list is
+// evicted when the cache is full.
+type PublicsCache struct {
+	sync.Mutex
+	size    int
+	entries map[string][]abstract.Point
+	order   []string //hashes, from the oldest to the newest
+}
+
+// NewPublicsCache returns an empty cache holding at most size lists.
+func NewPublicsCache(size int) *PublicsCache {
+	if size < 1 {
+		size = DefaultPublicsCacheSize
+	}
+	return &PublicsCache{
+		size:    size,
+		entries: make(map[string][]abstract.Point, size),
+	}
+}
+
+// Add stores the list of public keys and returns its hash.
+func (c *PublicsCache) Add(publics []abstract.Point) ([]byte, error) {
+	hash, err := HashPublics(publics)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	key := string(hash)
+	if _, ok := c.entries[key]; ok {
+		return hash, nil
+	}
+	if len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = publics
+	c.order = append(c.order, key)
+	return hash, nil
+}
+
+// Get returns the list of public keys of the given hash, nil if it is not in the cache.
+func (c *PublicsCache) Get(hash []byte) []abstract.Point {
+	c.Lock()
+	defer c.Unlock()
+	return c.entries[string(hash)]
+}
+
+// HashPublics returns the hash identifying a list of public keys.
+func HashPublics(publics []abstract.Point) ([]byte, error) {
+	hash := sha256.New()
+	for _, public := range publics {
+		if _, err := public.MarshalTo(hash); err != nil {
+			return nil, err
+		}
+	}
+	return hash.Sum(nil), nil
+}
+
+// DefaultServerCaches is the number of servers whose cache of public keys is kept,
+// the cache of the server that started a protocol instance the longest ago being
+// evicted first. An evicted server fetches the keys from its parent again.
+const DefaultServerCaches = 1024
+
+// serverCaches holds the cache of public keys of each server, shared by its protocol instances.
+var serverCaches = struct {
+	sync.Mutex
+	caches map[network.ServerIdentityID]*PublicsCache
+	order  []network.ServerIdentityID //from the least to the most recently used
+}{caches: make(map[network.ServerIdentityID]*PublicsCache)}
+
+// serverPublicsCache returns the cache of public keys of a server, creating it if needed.
+func serverPublicsCache(id network.ServerIdentityID) *PublicsCache {
+	serverCaches.Lock()
+	defer serverCaches.Unlock()
+	cache, ok := serverCaches.caches[id]
+	if ok {
+		for i, used := range serverCaches.order {
+			if used == id {
+				serverCaches.order = append(serverCaches.order[:i], serverCaches.order[i+1:]...)
+				break
+			}
+		}
+	} else {
+		if len(serverCaches.order) >= DefaultServerCaches {
+			delete(serverCaches.caches, serverCaches.order[0])
+			serverCaches.order = serverCaches.order[1:]
+		}
+		cache = NewPublicsCache(DefaultPublicsCacheSize)
+		serverCaches.caches[id] = cache
+	}
+	serverCaches.order = append(serverCaches.order, id)
+	return cache
+}
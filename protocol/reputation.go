@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// DefaultSubleaderReputation is the score below which a node isn't chosen as subleader.
+const DefaultSubleaderReputation = 0.5
+
+// DefaultExcludeReputation is the score below which a node is left out of the subtrees,
+// if the table excludes nodes.
+const DefaultExcludeReputation = 0.2
+
+// DefaultReputationRecovery is the score regained by an excluded node in each round.
+const DefaultReputationRecovery = 0.05
+
+// Outcome is the behavior of a node in a round, as seen by the root.
+type Outcome int
+
+const (
+	Signed     Outcome = iota //its commitment and response are in the signature
+	Absent                    //didn't commit in time, which includes refusing the proposal
+	Misbehaved                //sent a message breaking the protocol, e.g. an invalid partial signature
+)
+
+// Reputation is the standing of a node across rounds, between 0 and 1.
+type Reputation struct {
+	Server     *network.ServerIdentity
+	Score      float64
+	Signed     int //number of rounds with each outcome
+	Absent     int
+	Misbehaved int
+	Excluded   bool //left out of the subtrees until it recovers
+}
+
+// ReputationTable keeps the reputation of the nodes from one round to the next.
+// A node starts with a score of 1. Each round it signs brings it a quarter closer
+// to 1, each round it is absent takes a quarter of it, and each misbehavior halves it.
+// Nodes below SubleaderThreshold are not chosen as subleaders, and if Exclude is set,
+// nodes below ExcludeThreshold are left out of the subtrees, regaining Recovery
+// in each round until they are above the threshold again.
+type ReputationTable struct {
+	SubleaderThreshold float64 //DefaultSubleaderReputation if not set
+	ExcludeThreshold   float64 //DefaultExcludeReputation if not set
+	Exclude            bool
+	Recovery           float64 //DefaultReputationRecovery if not set
+
+	sync.Mutex
+	nodes map[network.ServerIdentityID]*Reputation
+}
+
+// NewReputationTable returns a table where every node has a perfect score.
+func NewReputationTable() *ReputationTable {
+	return &ReputationTable{nodes: make(map[network.ServerIdentityID]*Reputation)}
+}
+
+// Record updates the reputation of a node with its outcome in a round.
+func (t *ReputationTable) Record(server *network.ServerIdentity, outcome Outcome) {
+	t.Lock()
+	defer t.Unlock()
+	node := t.node(server)
+	switch outcome {
+	case Signed:
+		node.Signed++
+		node.Score += (1 - node.Score) / 4
+	case Absent:
+		node.Absent++
+		node.Score -= node.Score / 4
+	case Misbehaved:
+		node.Misbehaved++
+		node.Score /= 2
+	}
+	t.updateExcluded(node)
+}
+
+// Recover makes a node left out of a round regain some reputation.
+func (t *ReputationTable) Recover(server *network.ServerIdentity) {
+	t.Lock()
+	defer t.Unlock()
+	node := t.node(server)
+	recovery := t.Recovery
+	if recovery <= 0 {
+		recovery = DefaultReputationRecovery
+	}
+	node.Score += recovery
+	if node.Score > 1 {
+		node.Score = 1
+	}
+	t.updateExcluded(node)
+}
+
+// Score returns the reputation score of a node, 1 if it has none.
+func (t *ReputationTable) Score(id network.ServerIdentityID) float64 {
+	t.Lock()
+	defer t.Unlock()
+	if node, ok := t.nodes[id]; ok {
+		return node.Score
+	}
+	return 1
+}
+
+// CanLead returns true if the node can be chosen as subleader.
+func (t *ReputationTable) CanLead(id network.ServerIdentityID) bool {
+	threshold := t.SubleaderThreshold
+	if threshold <= 0 {
+		threshold = DefaultSubleaderReputation
+	}
+	return !t.Excluded(id) && t.Score(id) >= threshold
+}
+
+// Excluded returns true if the node is left out of the subtrees.
+func (t *ReputationTable) Excluded(id network.ServerIdentityID) bool {
+	t.Lock()
+	defer t.Unlock()
+	node, ok := t.nodes[id]
+	return ok && node.Excluded
+}
+
+// Allowed returns the first nNodes servers of the roster without the excluded ones,
+// or the roster itself if none is excluded. The first server, root of the trees, is always kept.
+// It is called once per round, the excluded nodes regaining some reputation for being left out.
+func (t *ReputationTable) Allowed(roster *onet.Roster, nNodes int) *onet.Roster {
+	if nNodes > len(roster.List) {
+		nNodes = len(roster.List)
+	}
+	if nNodes < 1 {
+		return roster
+	}
+	servers := []*network.ServerIdentity{roster.List[0]}
+	for _, server := range roster.List[1:nNodes] {
+		if t.Excluded(server.ID) {
+			t.Recover(server)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == nNodes {
+		return roster
+	}
+	return onet.NewRoster(servers)
+}
+
+// Reputations returns a copy of the reputation of every node with a record,
+// from the lowest score to the highest.
+func (t *ReputationTable) Reputations() []Reputation {
+	t.Lock()
+	defer t.Unlock()
+	reputations := make([]Reputation, 0, len(t.nodes))
+	for _, node := range t.nodes {
+		reputations = append(reputations, *node)
+	}
+	sort.Sort(byScore(reputations))
+	return reputations
+}
+
+// node returns the reputation of a server, creating it if needed.
+// The lock must be held.
+func (t *ReputationTable) node(server *network.ServerIdentity) *Reputation {
+	node, ok := t.nodes[server.ID]
+	if !ok {
+		node = &Reputation{Server: server, Score: 1}
+		t.nodes[server.ID] = node
+	}
+	return node
+}
+
+// updateExcluded excludes a node below the threshold, or includes it back above it.
+// The lock must be held.
+func (t *ReputationTable) updateExcluded(node *Reputation) {
+	threshold := t.ExcludeThreshold
+	if threshold <= 0 {
+		threshold = DefaultExcludeReputation
+	}
+	node.Excluded = t.Exclude && node.Score < threshold
+}
+
+// byScore sorts reputations in increasing score.
+type byScore []Reputation
+
+func (r byScore) Len() int           { return len(r) }
+func (r byScore) Less(i, j int) bool { return r[i].Score < r[j].Score }
+func (r byScore) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// roundOutcomes gathers the outcome of each node during a round, keeping the worst one,
+// so that the reputation table is updated once per node and round.
+type roundOutcomes struct {
+	sync.Mutex
+	servers  map[network.ServerIdentityID]*network.ServerIdentity
+	outcomes map[network.ServerIdentityID]Outcome
+	recorded bool //the outcomes are in the table, the later ones are ignored
+}
+
+// newRoundOutcomes returns the outcomes of a round with no node yet.
+func newRoundOutcomes() *roundOutcomes {
+	return &roundOutcomes{
+		servers:  make(map[network.ServerIdentityID]*network.ServerIdentity),
+		outcomes: make(map[network.ServerIdentityID]Outcome),
+	}
+}
+
+// set records the outcome of a node, unless it already has a worse one.
+func (o *roundOutcomes) set(server *network.ServerIdentity, outcome Outcome) {
+	if server == nil {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.recorded {
+		return
+	}
+	if previous, ok := o.outcomes[server.ID]; ok && previous >= outcome {
+		return
+	}
+	o.servers[server.ID] = server
+	o.outcomes[server.ID] = outcome
+}
+
+// recordIn updates the table with the outcome of every node of the round,
+// only the first time it is called.
+func (o *roundOutcomes) recordIn(table *ReputationTable) {
+	o.Lock()
+	defer o.Unlock()
+	if o.recorded {
+		return
+	}
+	o.recorded = true
+	for id, outcome := range o.outcomes {
+		table.Record(o.servers[id], outcome)
+	}
+}
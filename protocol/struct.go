@@ -16,7 +16,9 @@ import (
 
 // ProtocolName can be used from other packages to refer to this protocol.
 const ProtocolName = "CoSi"
-const subProtocolName = "SubCoSi"
+
+// SubProtocolName is the name of the protocol run in each subtree.
+const SubProtocolName = "SubCoSi"
 
 const DefaultProtocolTimeout = network.WaitRetry * time.Duration(network.MaxRetryConnect*2) * time.Millisecond
 const DefaultSubleaderTimeout = time.Duration(float64(DefaultProtocolTimeout) * 0.01)
@@ -24,9 +26,12 @@ const DefaultLeavesTimeout = time.Duration(float64(DefaultProtocolTimeout) * 0.0
 
 type Announcement struct {
 	 Proposal			[]byte
-	 Publics			[]abstract.Point
+	 PublicsHash		[]byte //the nodes resolve the public keys from their cache, or from their parent
 	 SubleaderTimeout	time.Duration
 	 LeafTimeout		time.Duration
+	 Round				int
+	 Nonce				[]byte //fresh for each start of the subprotocol, the challenge being bound to it
+	 Signature			[]byte //of the leader, on the other fields and the tree
 }
 
 // StructAnnouncement just contains Announcement and the data necessary to identify and
@@ -39,6 +44,14 @@ type StructAnnouncement struct {
 type Commitment struct {
 	CoSiCommitment abstract.Point
 	Mask           []byte
+	Latencies      []Latency //measured by a subleader from its children
+}
+
+// Latency is the round-trip time between a node and one of its children,
+// from the announcement to the commitment.
+type Latency struct {
+	Index int //of the child in the public keys
+	RTT   time.Duration
 }
 
 // StructCommitment just contains Commitment and the data necessary to identify and
@@ -50,6 +63,7 @@ type StructCommitment struct {
 
 type Challenge struct {
 	CoSiChallenge abstract.Scalar
+	Signature     []byte //of the leader, on the challenge, the tree, the round and the announcement
 }
 
 // StructChallenge just contains Challenge and the data necessary to identify and
@@ -76,3 +90,57 @@ type StructStop struct {
 	*onet.TreeNode
 	Stop
 }
+
+// PublicsRequest asks the parent for the public keys of an announcement,
+// missing from the cache of the node.
+type PublicsRequest struct {
+	Hash []byte
+}
+
+type StructPublicsRequest struct {
+	*onet.TreeNode
+	PublicsRequest
+}
+
+// PublicsReply holds the public keys requested by a child.
+type PublicsReply struct {
+	Publics []abstract.Point
+}
+
+type StructPublicsReply struct {
+	*onet.TreeNode
+	PublicsReply
+}
+
+// Blame is sent by a node to its parent, and on up to the root, when the node gives up
+// the round because of a node of its subtree breaking the protocol.
+type Blame struct {
+	Culprit onet.TreeNodeID
+	Message string //type of the message of the culprit, e.g. "Response"
+	Reason  string
+}
+
+type StructBlame struct {
+	*onet.TreeNode
+	Blame
+}
+
+// Ping is sent by the liveness monitor of the root to every node.
+type Ping struct {
+	Seq int
+}
+
+type StructPing struct {
+	*onet.TreeNode
+	Ping
+}
+
+// Pong answers a ping, as a heartbeat of the node.
+type Pong struct {
+	Seq int
+}
+
+type StructPong struct {
+	*onet.TreeNode
+	Pong
+}
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"bytes"
+	"sync"
 	"time"
 
 	"github.com/dedis/student_17_bftcosi/cosi"
@@ -18,7 +20,19 @@ type CoSiSubProtocolNode struct {
 	Proposal         []byte
 	SubleaderTimeout time.Duration
 	LeavesTimeout    time.Duration
-	hasStopped       bool //used since Shutdown can be called multiple time
+	Round            int
+	LeaderVerifier   LeaderVerifier //if set, called to check the leader of the announcement
+	ViolationReporter ViolationReporter //if set, called with every message breaking the protocol
+
+	//closed once by Shutdown, which can be called multiple times and from any goroutine.
+	//The message channels are never closed, as onet and the root may still send on them.
+	stopped          chan bool
+	stopOnce         sync.Once
+	publicsCache     *PublicsCache //of the server, shared with its other instances
+	started          time.Time //when the root started the subprotocol
+	nonce            []byte //of the announcement, the challenge must be bound to it
+	index            publicsIndex //of the public keys, only built if the node has children
+	blames           chan Violation //of the root protocol, only set on the root of the subprotocol
 
 	//protocol/subprotocol channels
 	subleaderNotResponding chan bool
@@ -30,6 +44,7 @@ type CoSiSubProtocolNode struct {
 	ChannelCommitment      chan StructCommitment
 	ChannelChallenge       chan StructChallenge
 	ChannelResponse        chan StructResponse
+	ChannelPublicsReply    chan StructPublicsReply
 }
 
 // The `NewSubProtocol` method is used to define the subprotocol and to register
@@ -38,16 +53,19 @@ func NewSubProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 
 	c := &CoSiSubProtocolNode{
 		TreeNodeInstance:       n,
-		hasStopped:				false,
+		stopped:                make(chan bool),
+		publicsCache:           serverPublicsCache(n.ServerIdentity().ID),
 	}
 
 	if n.IsRoot() {
-		c.subleaderNotResponding = make(chan bool)
-		c.subCommitment	= make(chan StructCommitment)
-		c.subResponse =	make(chan StructResponse)
+		//buffered so that the subprotocol never blocks if the root stopped listening
+		c.subleaderNotResponding = make(chan bool, 1)
+		c.subCommitment	= make(chan StructCommitment, 1)
+		c.subResponse =	make(chan StructResponse, 1)
 	}
 
-	for _, channel := range []interface{}{&c.ChannelAnnouncement, &c.ChannelCommitment, &c.ChannelChallenge, &c.ChannelResponse} {
+	for _, channel := range []interface{}{&c.ChannelAnnouncement, &c.ChannelCommitment, &c.ChannelChallenge, &c.ChannelResponse,
+		&c.ChannelPublicsReply} {
 		err := c.RegisterChannel(channel)
 		if err != nil {
 			return nil, errors.New("couldn't register channel: " + err.Error())
@@ -57,73 +75,125 @@ func NewSubProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	if err != nil {
 		return nil, errors.New("couldn't register stop handler: " + err.Error())
 	}
+	err = c.RegisterHandler(c.HandlePublicsRequest)
+	if err != nil {
+		return nil, errors.New("couldn't register public keys handler: " + err.Error())
+	}
+	err = c.RegisterHandler(c.HandleBlame)
+	if err != nil {
+		return nil, errors.New("couldn't register blame handler: " + err.Error())
+	}
 	return c, nil
 }
 
+// Shutdown stops the node, making Dispatch return at its next step.
 func (p *CoSiSubProtocolNode) Shutdown() error {
-	if !p.hasStopped {
-		close(p.ChannelAnnouncement)
-		close(p.ChannelCommitment)
-		close(p.ChannelChallenge)
-		close(p.ChannelResponse)
-		p.hasStopped = true
-	}
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
 	return nil
 }
 
 //Dispatch() is the main method of the subprotocol, running on each node and handling the messages in order
 func (p *CoSiSubProtocolNode) Dispatch() error {
+	defer p.Done()
 
 	// ----- Announcement -----
-	announcement, channelOpen := <-p.ChannelAnnouncement
-	if !channelOpen {
-		return nil
+	var announcement StructAnnouncement
+	var err error
+	for {
+		select {
+		case announcement = <-p.ChannelAnnouncement:
+		case <-p.stopped:
+			return nil
+		}
+		if !p.fromParent(announcement.TreeNode) {
+			p.reportViolation(announcement.TreeNode, "Announcement", errors.New("the sender is not the parent"))
+			continue
+		}
+		err = p.verifyAnnouncement(&announcement.Announcement)
+		if err == nil {
+			break
+		}
+		p.reportViolation(announcement.TreeNode, "Announcement", err)
 	}
 	log.Lvl3(p.ServerIdentity().Address, "received announcement")
-	p.Publics = announcement.Publics
+	if p.LeaderVerifier != nil && !p.IsRoot() {
+		err := p.LeaderVerifier(announcement.Round, p.Root().ServerIdentity)
+		if err != nil {
+			p.reportViolation(announcement.TreeNode, "Announcement", err)
+			return fmt.Errorf("refused announcement: %s", err)
+		}
+	}
+	p.Round = announcement.Round
+	p.Proposal = announcement.Proposal
+	p.nonce = announcement.Nonce
 	p.SubleaderTimeout = announcement.SubleaderTimeout
 	p.LeavesTimeout = announcement.LeafTimeout
+	if !p.IsRoot() { //the root set the public keys in Start
+		p.Publics, err = p.resolvePublics(announcement.PublicsHash)
+		if err != nil {
+			return err
+		} else if p.Publics == nil {
+			return nil //stopped
+		}
+	}
+	if p.index == nil && len(p.Children()) > 0 {
+		p.index = newPublicsIndex(p.Publics)
+	}
 
-	err := p.SendToChildren(&announcement.Announcement)
+	announced := time.Now()
+	err = sendToChildrenInParallel(p.TreeNodeInstance, &announcement.Announcement)
 	if err != nil {
 		return err
 	}
 
 	// ----- Commitment -----
+	//each child is accepted once, duplicates and other senders are discarded
+	children := newChildrenState(p.TreeNode())
 	commitments := make([]StructCommitment, 0)
-	if p.IsRoot() {
-		select { //one commitment expected
-		case commitment, channelOpen:= <-p.ChannelCommitment:
-			if !channelOpen {
-				return nil
+	masks := make(map[onet.TreeNodeID]*cosi.Mask) //checked mask of each accepted commitment
+	latencies := make([]Latency, 0)
+	timeout := p.LeavesTimeout
+	if p.IsRoot() { //one commitment expected, from the subleader
+		timeout = p.SubleaderTimeout
+	}
+	t := time.After(timeout)
+	loop:
+	for children.count(childCommitted) < len(p.Children()) {
+		select {
+		case commitment := <-p.ChannelCommitment:
+			err = children.commit(commitment.TreeNode)
+			if err != nil {
+				p.reportViolation(commitment.TreeNode, "Commitment", err)
+				continue
 			}
+			mask, err := checkChildMask(p.Suite(), p.Publics, p.index, commitment.TreeNode, commitment.Mask)
+			if err != nil {
+				children.reject(commitment.TreeNode)
+				p.reportViolation(commitment.TreeNode, "Commitment", err)
+				continue
+			}
+			masks[commitment.TreeNode.ID] = mask
 			commitments = append(commitments, commitment)
-		case <-time.After(p.SubleaderTimeout):
-			p.subleaderNotResponding <- true
-			return nil
-		}
-	} else {
-		t := time.After(p.LeavesTimeout)
-		loop:
-		for i:=0 ; i<len(p.Children()) ; i++ {
-			select {
-			case commitment, channelOpen := <-p.ChannelCommitment:
-				if !channelOpen {
-					return nil
-				}
-				commitments = append(commitments, commitment)
-			case <-t:
-				break loop
+			latencies = append(latencies, Latency{p.index.of(commitment.TreeNode.ServerIdentity.Public),
+				time.Since(announced)})
+		case <-t:
+			if p.IsRoot() {
+				p.subleaderNotResponding <- true
+				return nil
 			}
+			break loop
+		case <-p.stopped:
+			return nil
 		}
 	}
 
 	committedChildren := make([]*onet.TreeNode, 0)
+	childCommitments := make(map[onet.TreeNodeID]abstract.Point)
 	for _, commitment := range commitments {
-		if commitment.TreeNode.Parent != p.TreeNode() {
-			return errors.New("received a Commitment from a non-Children node")
-		}
 		committedChildren = append(committedChildren, commitment.TreeNode)
+		childCommitments[commitment.TreeNode.ID] = commitment.CoSiCommitment
 	}
 	log.Lvl3(p.ServerIdentity().Address, "finished receiving commitments, ", len(commitments), "commitment(s) received")
 
@@ -131,6 +201,10 @@ func (p *CoSiSubProtocolNode) Dispatch() error {
 
  	// if root, send commitment to super-protocol
 	if p.IsRoot() {
+		if len(commitments) == 0 { //the commitment of the subleader was rejected, replace it
+			p.subleaderNotResponding <- true
+			return nil
+		}
 		if len(commitments) != 1 {
 			return fmt.Errorf("root node in subprotocol should have received 1 commitment," +
 				"but received %d", len(commitments))
@@ -145,18 +219,43 @@ func (p *CoSiSubProtocolNode) Dispatch() error {
 		if err != nil {
 			return err
 		}
-		err = p.SendToParent(&Commitment{commitment, mask.Mask()})
+		err = p.SendToParent(&Commitment{commitment, mask.Mask(), latencies})
 		if err != nil {
 			return err
 		}
 	}
 
 	// ----- Challenge -----
-	challenge, channelOpen := <-p.ChannelChallenge
-	if !channelOpen {
-		return nil
+	var challenge StructChallenge
+	for {
+		select {
+		case challenge = <-p.ChannelChallenge:
+		case <-p.stopped:
+			return nil
+		}
+		if !p.fromParent(challenge.TreeNode) {
+			p.reportViolation(challenge.TreeNode, "Challenge", errors.New("the sender is not the parent"))
+			continue
+		}
+		err = p.verifyChallenge(&challenge.Challenge)
+		if err == nil {
+			break
+		}
+		p.reportViolation(challenge.TreeNode, "Challenge", err)
 	}
 	log.Lvl3(p.ServerIdentity().Address, "received challenge")
+
+	//the root signs the challenge for the nodes of the subtree
+	if p.IsRoot() {
+		message, err := challengeMessage(p.Tree().ID, p.Round, p.Proposal, p.nonce, challenge.CoSiChallenge)
+		if err != nil {
+			return err
+		}
+		challenge.Signature, err = signAsLeader(p.Suite(), p.Private(), p.Public(), message)
+		if err != nil {
+			return fmt.Errorf("couldn't sign the challenge: %s", err)
+		}
+	}
 	for _, TreeNode := range committedChildren {
 		err = p.SendTo(TreeNode, &challenge.Challenge)
 		if err != nil {
@@ -166,18 +265,33 @@ func (p *CoSiSubProtocolNode) Dispatch() error {
 
 	// ----- Response -----
 
-	//get response
-	if p.IsLeaf() {
-		p.ChannelResponse <- StructResponse{}
-	}
+	//get response, leaves have no committed children.
+	//Only the committed children are accepted, once each
 	responses := make([]StructResponse, 0)
 
-	for  i:=0;i<len(committedChildren);i++ {
-		response, channelOpen := <-p.ChannelResponse
-		if !channelOpen {
+	for len(responses) < len(committedChildren) {
+		select {
+		case response := <-p.ChannelResponse:
+			err = children.respond(response.TreeNode)
+			if err != nil {
+				p.reportViolation(response.TreeNode, "Response", err)
+				continue
+			}
+			//the aggregate can't be fixed once the challenge is sent, the round fails
+			id := response.TreeNode.ID
+			err = verifyChildResponse(p.Suite(), childCommitments[id], masks[id],
+				challenge.CoSiChallenge, response.CoSiReponse)
+			if err != nil {
+				p.reportViolation(response.TreeNode, "Response", err)
+				if blameErr := p.blame(response.TreeNode, "Response", err); blameErr != nil {
+					log.Lvl2(p.ServerIdentity().Address, "couldn't send the blame:", blameErr)
+				}
+				return fmt.Errorf("invalid response from %s: %s", response.TreeNode.ServerIdentity.Address, err)
+			}
+			responses = append(responses, response)
+		case <-p.stopped:
 			return nil
 		}
-		responses = append(responses, response)
 	}
 	log.Lvl3(p.ServerIdentity().Address, "received all", len(responses),"response(s)")
 
@@ -201,16 +315,159 @@ func (p *CoSiSubProtocolNode) Dispatch() error {
 		}
 	}
 
-	//TODO: see if should stop node or be ready for another proposal
 	return nil
 }
 
+// fromParent returns true if the message of the sender is expected from the parent.
+// The root of the subprotocol receives its messages from the root protocol, through itself.
+func (p *CoSiSubProtocolNode) fromParent(sender *onet.TreeNode) bool {
+	if sender == nil {
+		return false
+	}
+	if p.IsRoot() {
+		return sender.ID == p.TreeNode().ID
+	}
+	return sender.ID == p.Parent().ID
+}
+
+// verifyAnnouncement checks that the announcement has a nonce and is signed by the root,
+// which doesn't check its own. The key of the root comes from the tree shipped by the parent,
+// only the LeaderVerifier anchoring it in the roster known by the node.
+func (p *CoSiSubProtocolNode) verifyAnnouncement(announcement *Announcement) error {
+	if p.IsRoot() {
+		return nil
+	}
+	if len(announcement.Nonce) != NonceSize {
+		return fmt.Errorf("the nonce should be %d bytes long, but is %d bytes long", NonceSize, len(announcement.Nonce))
+	}
+	message := announcementMessage(p.Tree().ID, announcement)
+	return verifyLeaderSignature(p.Suite(), p.Root().ServerIdentity.Public, message, announcement.Signature)
+}
+
+// resolvePublics returns the public keys of the given hash from the cache of the server,
+// or fetches them from the parent. It returns nil if the node stopped meanwhile.
+func (p *CoSiSubProtocolNode) resolvePublics(hash []byte) ([]abstract.Point, error) {
+	if publics := p.publicsCache.Get(hash); publics != nil {
+		return publics, nil
+	}
+	log.Lvl3(p.ServerIdentity().Address, "fetches the public keys from its parent")
+	err := p.SendToParent(&PublicsRequest{hash})
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.After(p.LeavesTimeout)
+	for {
+		select {
+		case reply := <-p.ChannelPublicsReply:
+			if !p.fromParent(reply.TreeNode) {
+				p.reportViolation(reply.TreeNode, "PublicsReply", errors.New("the sender is not the parent"))
+				continue
+			}
+			replyHash, err := HashPublics(reply.Publics)
+			if err != nil || !bytes.Equal(replyHash, hash) || len(reply.Publics) == 0 {
+				p.reportViolation(reply.TreeNode, "PublicsReply",
+					errors.New("the public keys don't match the hash of the announcement"))
+				continue
+			}
+			_, err = p.publicsCache.Add(reply.Publics)
+			if err != nil {
+				return nil, err
+			}
+			return reply.Publics, nil
+		case <-t:
+			return nil, errors.New("the parent didn't send the public keys in time")
+		case <-p.stopped:
+			return nil, nil
+		}
+	}
+}
+
+// HandlePublicsRequest sends to a child the public keys missing from its cache.
+func (p *CoSiSubProtocolNode) HandlePublicsRequest(request StructPublicsRequest) error {
+	if request.TreeNode == nil || request.TreeNode.Parent == nil || request.TreeNode.Parent.ID != p.TreeNode().ID {
+		p.reportViolation(request.TreeNode, "PublicsRequest", errors.New("the sender is not a child"))
+		return nil
+	}
+	publics := p.publicsCache.Get(request.Hash)
+	if publics == nil && p.Publics != nil {
+		//evicted from the cache, but still held by this instance
+		if hash, err := HashPublics(p.Publics); err == nil && bytes.Equal(hash, request.Hash) {
+			publics = p.Publics
+		}
+	}
+	if publics == nil {
+		return fmt.Errorf("%s doesn't hold the public keys requested by %s", p.ServerIdentity().Address,
+			request.TreeNode.ServerIdentity.Address)
+	}
+	return p.SendTo(request.TreeNode, &PublicsReply{publics})
+}
+
+// HandleBlame takes into account the blame of a child that gave up the round: the culprit,
+// which must be in the subtree of the child, is reported and the blame passed on to the root.
+// As for its aggregate, the node relies on the child for what happens in its subtree.
+func (p *CoSiSubProtocolNode) HandleBlame(blame StructBlame) error {
+	if blame.TreeNode == nil || blame.TreeNode.Parent == nil || blame.TreeNode.Parent.ID != p.TreeNode().ID {
+		p.reportViolation(blame.TreeNode, "Blame", errors.New("the sender is not a child"))
+		return nil
+	}
+	culprit := p.Tree().Search(blame.Culprit)
+	if culprit == nil || !inSubtree(culprit, blame.TreeNode) {
+		p.reportViolation(blame.TreeNode, "Blame", errors.New("the culprit is not in the subtree of the sender"))
+		return nil
+	}
+	reason := errors.New(blame.Reason)
+	p.reportViolation(culprit, blame.Message, reason)
+	return p.blame(culprit, blame.Message, reason)
+}
+
+// blame tells the root that the node gives up the round because of the culprit: the root
+// of the subprotocol passes it to the root protocol, which aborts, the other nodes to their parent.
+func (p *CoSiSubProtocolNode) blame(culprit *onet.TreeNode, message string, reason error) error {
+	if !p.IsRoot() {
+		return p.SendToParent(&Blame{culprit.ID, message, reason.Error()})
+	}
+	select {
+	case p.blames <- Violation{culprit.ServerIdentity, message, reason.Error()}:
+	default: //the root already gives up, or runs the subprotocol without listening
+	}
+	return nil
+}
+
+// verifyChallenge checks that the challenge of the current round is signed by the root,
+// the root signing it only once received from the root protocol.
+func (p *CoSiSubProtocolNode) verifyChallenge(challenge *Challenge) error {
+	if p.IsRoot() {
+		return nil
+	}
+	message, err := challengeMessage(p.Tree().ID, p.Round, p.Proposal, p.nonce, challenge.CoSiChallenge)
+	if err != nil {
+		return err
+	}
+	return verifyLeaderSignature(p.Suite(), p.Root().ServerIdentity.Public, message, challenge.Signature)
+}
+
+// reportViolation logs a message breaking the protocol and passes it to the reporter, if any.
+func (p *CoSiSubProtocolNode) reportViolation(sender *onet.TreeNode, message string, reason error) {
+	v := Violation{Message: message, Reason: reason.Error()}
+	if sender != nil {
+		v.Sender = sender.ServerIdentity
+	}
+	log.Lvl2(p.ServerIdentity().Address, "discarded", v)
+	if p.ViolationReporter != nil {
+		p.ViolationReporter(v)
+	}
+}
+
 //HandleStop is called when a Stop message is send to this node.
-// It broadcasts the message and stops the node
+// It propagates the message to the children and stops the node. The root also
+// sends it directly to every node, so that the leaves stop even if the subleader failed.
 func (p *CoSiSubProtocolNode) HandleStop(stop StructStop) error {
 	defer p.Done()
 	if p.IsRoot() {
 		p.Broadcast(&stop.Stop)
+	} else if !p.IsLeaf() {
+		p.SendToChildren(&stop.Stop)
 	}
 	return nil
 }
@@ -230,9 +487,23 @@ func (p *CoSiSubProtocolNode) Start() error {
 		p.LeavesTimeout = DefaultLeavesTimeout
 	}
 
+	publicsHash, err := p.publicsCache.Add(p.Publics)
+	if err != nil {
+		return err
+	}
 	announcement := StructAnnouncement{p.TreeNode(),
-		Announcement{p.Proposal, p.Publics,
-		p.SubleaderTimeout, p.LeavesTimeout}}
-	p.ChannelAnnouncement <- announcement
+		Announcement{p.Proposal, publicsHash,
+		p.SubleaderTimeout, p.LeavesTimeout, p.Round, newNonce(), nil}}
+	message := announcementMessage(p.Tree().ID, &announcement.Announcement)
+	announcement.Signature, err = signAsLeader(p.Suite(), p.Private(), p.Public(), message)
+	if err != nil {
+		return fmt.Errorf("couldn't sign the announcement: %s", err)
+	}
+	p.started = time.Now()
+	select {
+	case p.ChannelAnnouncement <- announcement:
+	case <-p.stopped:
+		return errors.New("subprotocol stopped before starting")
+	}
 	return nil
 }
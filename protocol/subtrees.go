@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultFanoutCost is the time assumed for a node to send a message to one more child,
+// until it is measured.
+const DefaultFanoutCost = time.Millisecond
+
+// DefaultRTT is the round-trip time assumed between a subleader and its leaves,
+// until it is measured.
+const DefaultRTT = 10 * time.Millisecond
+
+// subtreesHysteresis is the relative gain required to change the number of subtrees,
+// so that small variations of the measures don't regenerate the trees every round.
+const subtreesHysteresis = 0.1
+
+// subtreesCost estimates the time the messages of a phase take to reach every node
+// with nSubtrees subtrees: the root sends one message per subtree, then each subleader
+// sends one message per leaf after a round-trip. Without leaves, the tree is a star.
+func subtreesCost(nNodes, nSubtrees int, fanout, rtt time.Duration) time.Duration {
+	others := nNodes - 1
+	cost := time.Duration(nSubtrees) * fanout
+	leaves := (others+nSubtrees-1)/nSubtrees - 1 //in the largest subtree
+	if leaves > 0 {
+		cost += rtt + time.Duration(leaves)*fanout
+	}
+	return cost
+}
+
+// AutoSubtrees returns the number of subtrees minimizing the cost of a phase
+// for the given fan-out cost and round-trip time. With equal costs at every
+// level, it is around the square root of the number of nodes, and a star when
+// the round-trip time outweighs sending to every node from the root.
+func AutoSubtrees(nNodes int, fanout, rtt time.Duration) int {
+	if nNodes <= 2 {
+		return 1
+	}
+	best := 1
+	bestCost := subtreesCost(nNodes, 1, fanout, rtt)
+	for k := 2; k < nNodes; k++ {
+		cost := subtreesCost(nNodes, k, fanout, rtt)
+		if cost < bestCost {
+			best, bestCost = k, cost
+		}
+	}
+	return best
+}
+
+// CostModel chooses the number of subtrees from the fan-out cost of the root and
+// the round-trip times between subleaders and leaves measured in the previous rounds.
+// It keeps its previous choice unless the new one is clearly better.
+type CostModel struct {
+	sync.Mutex
+	fanout time.Duration //average cost of a subtree at the root, beyond the round-trips of its leaves
+	rtt    time.Duration //average round-trip time between a subleader and a leaf
+	chosen map[int]int   //last number of subtrees chosen for each number of nodes
+}
+
+// NewCostModel returns a model using the default costs until it has measures.
+func NewCostModel() *CostModel {
+	return &CostModel{fanout: DefaultFanoutCost, rtt: DefaultRTT, chosen: make(map[int]int)}
+}
+
+// ObserveFanout records the cost of one subtree at the root: the round-trip from the
+// start of its subprotocol to its commitment, less the round-trip of its slowest leaf.
+func (m *CostModel) ObserveFanout(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.fanout = average(m.fanout, d)
+}
+
+// ObserveRTT records a round-trip time between a subleader and a leaf.
+func (m *CostModel) ObserveRTT(rtt time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.rtt = average(m.rtt, rtt)
+}
+
+// Subtrees returns the number of subtrees to use with the given number of nodes.
+func (m *CostModel) Subtrees(nNodes int) int {
+	m.Lock()
+	defer m.Unlock()
+	best := AutoSubtrees(nNodes, m.fanout, m.rtt)
+	previous, ok := m.chosen[nNodes]
+	if ok && previous != best {
+		bestCost := float64(subtreesCost(nNodes, best, m.fanout, m.rtt))
+		previousCost := float64(subtreesCost(nNodes, previous, m.fanout, m.rtt))
+		if bestCost > previousCost*(1-subtreesHysteresis) {
+			return previous
+		}
+	}
+	m.chosen[nNodes] = best
+	return best
+}
+
+// average returns the exponentially weighted moving average of the measures
+// after the new one, giving it a weight of one eighth.
+func average(current, measure time.Duration) time.Duration {
+	return current + (measure-current)/8
+}
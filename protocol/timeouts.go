@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// DefaultTimeoutPercentile is the percentile of the recent samples the timeouts are derived from.
+const DefaultTimeoutPercentile = 0.95
+
+// DefaultTimeoutFactor multiplies the percentile of the recent samples.
+const DefaultTimeoutFactor = 2.0
+
+// DefaultTimeoutWindow is the number of recent samples kept for each node.
+const DefaultTimeoutWindow = 10
+
+// DefaultMinTimeout is the lower bound of the derived timeouts.
+const DefaultMinTimeout = 10 * time.Millisecond
+
+// TimeoutEstimator derives the timeouts of a round from the times observed by
+// the root in the previous ones: the round-trip times from the subleaders to
+// their leaves, reported in the commitments, and the times between the
+// announcement and the commitment of each subtree.
+// Each timeout is Factor times the Percentile of the recent samples plus Margin,
+// bounded by Min and Max. Until a subtree has committed, the static timeouts are used.
+type TimeoutEstimator struct {
+	Percentile float64       //DefaultTimeoutPercentile if not set
+	Factor     float64       //DefaultTimeoutFactor if not set
+	Margin     time.Duration //added to every timeout
+	Min        time.Duration //DefaultMinTimeout if not set
+	Max        time.Duration //DefaultSubleaderTimeout if not set
+	Window     int           //DefaultTimeoutWindow if not set
+
+	sync.Mutex
+	leaves   map[string][]time.Duration //round-trip times of each leaf, by public key
+	subtrees map[string][]time.Duration //commitment times of each subleader, by public key
+}
+
+// NewTimeoutEstimator returns an estimator with the default parameters and no samples.
+func NewTimeoutEstimator() *TimeoutEstimator {
+	return &TimeoutEstimator{
+		leaves:   make(map[string][]time.Duration),
+		subtrees: make(map[string][]time.Duration),
+	}
+}
+
+// ObserveLeaf records the round-trip time between a subleader and one of its leaves.
+func (e *TimeoutEstimator) ObserveLeaf(public abstract.Point, rtt time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	e.leaves[public.String()] = e.add(e.leaves[public.String()], rtt)
+}
+
+// ObserveSubtree records the time between the announcement to a subleader and its commitment.
+func (e *TimeoutEstimator) ObserveSubtree(public abstract.Point, duration time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	e.subtrees[public.String()] = e.add(e.subtrees[public.String()], duration)
+}
+
+// Timeouts returns the subleader and leaves timeouts derived from the recent samples,
+// and false if no subtree committed yet, in which case the static timeouts apply.
+func (e *TimeoutEstimator) Timeouts() (subleader, leaves time.Duration, ok bool) {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.subtrees) == 0 {
+		return 0, 0, false
+	}
+
+	leaves = e.bound(0)
+	if len(e.leaves) > 0 {
+		leaves = e.bound(e.derive(e.percentile(e.leaves)))
+	}
+
+	//the subleader also waits for its leaves
+	subtree := e.percentile(e.subtrees)
+	subleader = e.derive(subtree)
+	if subleader < leaves+subtree {
+		subleader = leaves + subtree
+	}
+	return e.bound(subleader), leaves, true
+}
+
+// add appends a sample, keeping only the most recent ones.
+// The lock must be held.
+func (e *TimeoutEstimator) add(samples []time.Duration, sample time.Duration) []time.Duration {
+	window := e.Window
+	if window < 1 {
+		window = DefaultTimeoutWindow
+	}
+	samples = append(samples, sample)
+	if len(samples) > window {
+		samples = samples[len(samples)-window:]
+	}
+	return samples
+}
+
+// percentile returns the configured percentile of the samples of every node.
+// The lock must be held.
+func (e *TimeoutEstimator) percentile(nodes map[string][]time.Duration) time.Duration {
+	p := e.Percentile
+	if p <= 0 || p > 1 {
+		p = DefaultTimeoutPercentile
+	}
+	var all durations
+	for _, samples := range nodes {
+		all = append(all, samples...)
+	}
+	if len(all) == 0 {
+		return 0
+	}
+	sort.Sort(all)
+	index := int(math.Ceil(p*float64(len(all)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return all[index]
+}
+
+// derive applies the factor and the margin to a percentile.
+func (e *TimeoutEstimator) derive(percentile time.Duration) time.Duration {
+	factor := e.Factor
+	if factor <= 0 {
+		factor = DefaultTimeoutFactor
+	}
+	return time.Duration(float64(percentile)*factor) + e.Margin
+}
+
+// bound keeps a timeout between the minimum and the maximum.
+func (e *TimeoutEstimator) bound(timeout time.Duration) time.Duration {
+	min, max := e.Min, e.Max
+	if min <= 0 {
+		min = DefaultMinTimeout
+	}
+	if max <= 0 {
+		max = DefaultSubleaderTimeout
+	}
+	if timeout < min {
+		return min
+	} else if timeout > max {
+		return max
+	}
+	return timeout
+}
+
+// durations sorts time durations in increasing order.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+
+	"gopkg.in/dedis/onet.v1"
+)
+
+// DefaultTreeCacheSize is the number of rosters whose subtrees are kept, the subtrees
+// used the longest ago being evicted first, with their backups.
+const DefaultTreeCacheSize = 16
+
+// treeKey identifies the subtrees generated for a roster.
+type treeKey struct {
+	roster    onet.RosterID
+	nNodes    int
+	nSubtrees int
+}
+
+// TreeCache keeps the subtrees generated by the root from one round to the next.
+// The nodes keep the trees they received by ID, so reusing the same subtrees
+// ships them to the nodes only in the first round. When a subleader is replaced,
+// its new subtree replaces the old one, so the next rounds start with it.
+// The subtrees of the backup subleaders are kept the same way. Only the subtrees of the
+// Size rosters, numbers of nodes and of subtrees used most recently are kept.
+// As the signed messages of different rounds then share the tree ID, the nodes tell
+// them apart by the nonce of each announcement, to which the challenge is bound.
+type TreeCache struct {
+	sync.Mutex
+	Size    int //DefaultTreeCacheSize if not set
+	trees   map[treeKey][]*onet.Tree
+	order   []treeKey                  //from the least to the most recently used
+	backups map[onet.TreeID]*onet.Tree //subtree of the backup subleader of each cached subtree
+}
+
+// NewTreeCache returns an empty cache.
+func NewTreeCache() *TreeCache {
+	return &TreeCache{
+		trees:   make(map[treeKey][]*onet.Tree),
+		backups: make(map[onet.TreeID]*onet.Tree),
+	}
+}
+
+// Trees returns the subtrees of the roster, as GenTrees, generating them only
+// if they are not cached.
+func (c *TreeCache) Trees(roster *onet.Roster, nNodes, nSubtrees int) ([]*onet.Tree, error) {
+	if roster == nil {
+		return nil, errors.New("the roster is nil")
+	}
+	c.Lock()
+	defer c.Unlock()
+	key := treeKey{roster.ID, nNodes, nSubtrees}
+	trees, ok := c.trees[key]
+	if ok {
+		c.forget(key)
+	} else {
+		var err error
+		trees, err = GenTrees(roster, nNodes, nSubtrees)
+		if err != nil {
+			return nil, err
+		}
+		size := c.Size
+		if size < 1 {
+			size = DefaultTreeCacheSize
+		}
+		for len(c.order) >= size {
+			c.evict(c.order[0])
+		}
+		c.trees[key] = trees
+	}
+	c.order = append(c.order, key)
+	return append([]*onet.Tree{}, trees...), nil
+}
+
+// Backup returns the subtree of the roster of a subtree with another subleader, at the
+// given roster index, generating it only the first time.
+func (c *TreeCache) Backup(tree *onet.Tree, subleader int) (*onet.Tree, error) {
+	c.Lock()
+	defer c.Unlock()
+	backup, ok := c.backups[tree.ID]
+	if ok && backup.Root.Children[0].RosterIndex == subleader {
+		return backup, nil
+	}
+	backup, err := GenSubtree(tree.Roster, subleader)
+	if err != nil {
+		return nil, err
+	}
+	if c.cached(tree.ID) { //the backups of evicted subtrees would never be dropped
+		c.backups[tree.ID] = backup
+	}
+	return backup, nil
+}
+
+// Replace replaces a cached subtree by the subtree of its new subleader.
+// It does nothing if the old subtree is not cached anymore.
+func (c *TreeCache) Replace(old, tree *onet.Tree) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.backups, old.ID)
+	for _, trees := range c.trees {
+		for i := range trees {
+			if trees[i].ID == old.ID {
+				trees[i] = tree
+				return
+			}
+		}
+	}
+}
+
+// Remove drops the subtrees generated with the given one, so that the next round
+// generates new ones, e.g. once every subleader of the subtree failed.
+func (c *TreeCache) Remove(subtree *onet.Tree) {
+	c.Lock()
+	defer c.Unlock()
+	for key, trees := range c.trees {
+		for _, tree := range trees {
+			if tree.ID == subtree.ID {
+				c.evict(key)
+				return
+			}
+		}
+	}
+}
+
+// cached returns true if the subtree is in the cache. It must be called with the lock held.
+func (c *TreeCache) cached(id onet.TreeID) bool {
+	for _, trees := range c.trees {
+		for _, tree := range trees {
+			if tree.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evict drops the subtrees of a key and their backups. It must be called with the lock held.
+func (c *TreeCache) evict(key treeKey) {
+	for _, tree := range c.trees[key] {
+		delete(c.backups, tree.ID)
+	}
+	delete(c.trees, key)
+	c.forget(key)
+}
+
+// forget removes a key from the order of use. It must be called with the lock held.
+func (c *TreeCache) forget(key treeKey) {
+	for i, used := range c.order {
+		if used == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			return
+		}
+	}
+}
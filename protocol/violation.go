@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Violation describes a message that breaks the protocol, and the node that sent it.
+type Violation struct {
+	Sender  *network.ServerIdentity
+	Message string //type of the message, e.g. "Commitment"
+	Reason  string
+}
+
+// String returns a readable description of the violation.
+func (v Violation) String() string {
+	sender := "unknown node"
+	if v.Sender != nil {
+		sender = v.Sender.Address.String()
+	}
+	return fmt.Sprintf("%s from %s: %s", v.Message, sender, v.Reason)
+}
+
+// ViolationReporter is called with every violation detected by a node.
+type ViolationReporter func(Violation)
+
+// childPhase is the last message received from a child of a node.
+type childPhase int
+
+const (
+	childAnnounced childPhase = iota //nothing received yet
+	childCommitted
+	childResponded
+	childRejected //its commitment was refused, nothing else is accepted from it
+)
+
+// childrenState tracks the phase of each child of a node, so that the node
+// accepts exactly one commitment and then one response from each of them.
+type childrenState struct {
+	phases map[onet.TreeNodeID]childPhase
+}
+
+// newChildrenState returns the state of the children of a node, none of them
+// having sent anything yet.
+func newChildrenState(node *onet.TreeNode) *childrenState {
+	phases := make(map[onet.TreeNodeID]childPhase, len(node.Children))
+	for _, child := range node.Children {
+		phases[child.ID] = childAnnounced
+	}
+	return &childrenState{phases}
+}
+
+// commit records the commitment of a child, or returns why it is refused.
+func (c *childrenState) commit(sender *onet.TreeNode) error {
+	phase, ok := c.phases[sender.ID]
+	if !ok {
+		return errors.New("the sender is not a child")
+	}
+	if phase != childAnnounced {
+		return errors.New("duplicate commitment")
+	}
+	c.phases[sender.ID] = childCommitted
+	return nil
+}
+
+// respond records the response of a child, or returns why it is refused.
+func (c *childrenState) respond(sender *onet.TreeNode) error {
+	phase, ok := c.phases[sender.ID]
+	if !ok {
+		return errors.New("the sender is not a child")
+	}
+	switch phase {
+	case childAnnounced:
+		return errors.New("response without commitment")
+	case childRejected:
+		return errors.New("response after a rejected commitment")
+	case childResponded:
+		return errors.New("duplicate response")
+	}
+	c.phases[sender.ID] = childResponded
+	return nil
+}
+
+// reject records that the commitment of a child is refused.
+func (c *childrenState) reject(sender *onet.TreeNode) {
+	if _, ok := c.phases[sender.ID]; ok {
+		c.phases[sender.ID] = childRejected
+	}
+}
+
+// count returns the number of children at the given phase or further,
+// the rejected children being past every phase.
+func (c *childrenState) count(phase childPhase) int {
+	n := 0
+	for _, p := range c.phases {
+		if p >= phase {
+			n++
+		}
+	}
+	return n
+}
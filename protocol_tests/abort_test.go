@@ -0,0 +1,111 @@
+package protocol_tests
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// protocolGoroutine matches the stack of a goroutine running code of the protocol package
+var protocolGoroutine = regexp.MustCompile(`student_17_bftcosi/protocol\.`)
+
+// Tests that every node is done, with no goroutine of the protocol left,
+// after a successful run and after the root gave up
+func TestAbortNoLeak(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	scenarios := []struct {
+		name      string
+		challenge bool //the first leaf ignores the challenge, so the responses never come
+		policy    cosi.Policy
+		signature bool
+	}{
+		{"success", false, nil, true},
+		{"unattainable policy", false, cosi.ThresholdPolicy{T: nNodes + 1}, false},
+		{"missing response", true, nil, false},
+	}
+
+	for _, scenario := range scenarios {
+		local := onet.NewLocalTest()
+		servers, _, tree := local.GenTree(nNodes, false)
+
+		if scenario.challenge {
+			leafs, err := protocol.GetLeafsIDs(tree, nNodes, nSubtrees)
+			if err != nil {
+				local.CloseAll()
+				t.Fatal(err)
+			}
+			for _, s := range servers {
+				if s.ServerIdentity.ID.Equal(leafs[0]) {
+					fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+						fault.Rule{Message: "Challenge", Action: fault.Drop})
+				}
+			}
+		}
+
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.ProtocolTimeout = time.Second
+		cosiProtocol.Policy = scenario.policy
+		err = cosiProtocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		select {
+		case <-cosiProtocol.FinalSignature:
+			if !scenario.signature {
+				local.CloseAll()
+				t.Fatal(scenario.name, ": expected the root to give up, but got a signature")
+			}
+		case <-time.After(3 * time.Second):
+			if scenario.signature {
+				local.CloseAll()
+				t.Fatal(scenario.name, ": didn't get signature in time")
+			}
+		}
+
+		//check before closing the servers, which would stop the remaining instances
+		err = waitProtocolGoroutines(5 * time.Second)
+		local.CloseAll()
+		if err != nil {
+			t.Fatal(scenario.name, ":", err)
+		}
+	}
+}
+
+// waitProtocolGoroutines waits until no goroutine runs code of the protocol package,
+// and returns an error with their stacks if some are still running after the timeout.
+func waitProtocolGoroutines(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		if !protocolGoroutine.Match(buf) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("goroutines of the protocol are still running:\n%s", buf)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
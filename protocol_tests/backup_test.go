@@ -0,0 +1,158 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests that every node signs with backup subleaders, whichever aggregate arrives first
+func TestBackupSubleaders(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	proposal := []byte{0xFF}
+
+	_, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	for _, nSubtrees := range []int{1, 3, 9} {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.SubleaderTimeout = 4 * time.Second
+		cosiProtocol.LeavesTimeout = 2 * time.Second
+		cosiProtocol.BackupSubleaders = true
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		var signature []byte
+		select {
+		case signature = <-cosiProtocol.FinalSignature:
+		case <-time.After(10 * time.Second):
+			t.Fatal("didn't get signature in time with", nSubtrees, "subtree(s)")
+		}
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+		if err != nil {
+			t.Fatal("didn't get a valid signature with", nSubtrees, "subtree(s):", err)
+		}
+	}
+}
+
+// Tests that the backup subleader commits when the subleader fails, without restart
+func TestBackupSubleaderFailure(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 3
+	subleaderTimeout := 5 * time.Second
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	subleaders, err := protocol.GetSubleaderIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		if s.ServerIdentity.ID.Equal(subleaders[0]) {
+			fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+				fault.Rule{Message: "Announcement", Action: fault.Drop})
+		}
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.SubleaderTimeout = subleaderTimeout
+	cosiProtocol.LeavesTimeout = 500 * time.Millisecond
+	cosiProtocol.BackupSubleaders = true
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	//the backup subleader only waits for the failed subleader as a leaf
+	var signature []byte
+	select {
+	case signature = <-cosiProtocol.FinalSignature:
+	case <-time.After(subleaderTimeout):
+		t.Fatal("didn't get signature before the subleader timeout")
+	}
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: nNodes - 1})
+	if err != nil {
+		t.Fatal("didn't get a valid signature:", err)
+	}
+	if cosiProtocol.Stats.SubleaderRestarts != 0 {
+		t.Fatal("expected no subleader restart, but got", cosiProtocol.Stats.SubleaderRestarts)
+	}
+	if cosiProtocol.Stats.BackupCommitments < 1 {
+		t.Fatal("expected the commitment of a backup subleader to be used")
+	}
+}
+
+// Tests that the tree cache reuses the subtrees of the backup subleaders
+func TestTreeCacheBackup(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(10, false)
+
+	cache := protocol.NewTreeCache()
+	trees, err := cache.Trees(roster, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := cache.Backup(trees[0], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backup.Root.Children[0].ServerIdentity.ID.Equal(trees[0].Roster.List[2].ID) {
+		t.Fatal("the backup subleader should be the node at the given index")
+	}
+	again, err := cache.Backup(trees[0], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != backup.ID {
+		t.Fatal("the backup subtree should be reused")
+	}
+
+	//once the backup replaced the subtree, a new backup is generated
+	cache.Replace(trees[0], backup)
+	other, err := cache.Backup(backup, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == backup.ID || other.Root.Children[0].RosterIndex != 3 {
+		t.Fatal("expected a new backup subtree with the node at index 3 as subleader")
+	}
+}
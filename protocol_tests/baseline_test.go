@@ -0,0 +1,74 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests the baseline protocol on stars and balanced trees
+func TestBaselineProtocol(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	nodes := []int{1, 2, 5, 13, 24}
+	branchingFactors := []int{1, 2, 4}
+	proposal := []byte{0xFF}
+
+	for _, nNodes := range nodes {
+		for _, bf := range branchingFactors {
+			log.Lvl2("test asking for", nNodes, "nodes and branching factor", bf)
+
+			_, roster, _ := local.GenTree(nNodes, false)
+			trees := []*onet.Tree{
+				roster.GenerateNaryTree(nNodes - 1),
+				roster.GenerateNaryTree(bf),
+			}
+
+			for _, tree := range trees {
+				//get public keys
+				publics := make([]abstract.Point, tree.Size())
+				for i, node := range tree.List() {
+					publics[i] = node.ServerIdentity.Public
+				}
+
+				//start protocol
+				pi, err := local.CreateProtocol(protocol.TreeProtocolName, tree)
+				if err != nil {
+					local.CloseAll()
+					t.Fatal("Error in creation of protocol:", err)
+				}
+				baseline := pi.(*protocol.CoSiTreeNode)
+				baseline.Proposal = proposal
+				baseline.LeavesTimeout = protocol.DefaultLeavesTimeout
+				err = baseline.Start()
+				if err != nil {
+					local.CloseAll()
+					t.Fatal("Error in starting of protocol:", err)
+				}
+
+				//get and verify signature
+				var signature []byte
+				select {
+				case signature = <-baseline.FinalSignature:
+				case <-time.After(10 * time.Second):
+					local.CloseAll()
+					t.Fatal("didn't get signature in time")
+				}
+				err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+				if err != nil {
+					local.CloseAll()
+					t.Fatal("didn't get a valid signature:", err)
+				}
+			}
+
+			local.CloseAll()
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package protocol_tests
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests that delayed commitments within the leaves timeout are still aggregated
+func TestFaultDelayedCommitments(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//delay commitments received by every node
+	for _, s := range servers {
+		fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+			fault.Rule{Message: "Commitment", Action: fault.Delay, Delay: 50 * time.Millisecond})
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = nSubtrees
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	err = getAndVerifySignature(cosiProtocol, publics, proposal, cosi.CompletePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a corrupted response of a leaf makes the round abort at once, its subleader
+// blaming it up to the root, which reports the leaf
+func TestFaultCorruptedResponse(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//corrupt the responses sent by the first leaf
+	leafs, err := protocol.GetLeafsIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		fault.Install(s, local.Overlays[s.ServerIdentity.ID], fault.Rule{Message: "Response",
+			Action: fault.Corrupt, Senders: []network.ServerIdentityID{leafs[0]}})
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.ProtocolTimeout = protocol.DefaultProtocolTimeout / 5000
+	violations := make(chan protocol.Violation, 10)
+	cosiProtocol.ViolationReporter = func(v protocol.Violation) {
+		select {
+		case violations <- v:
+		default:
+		}
+	}
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	//the root learns about the leaf well before its protocol timeout
+	select {
+	case violation := <-violations:
+		if violation.Message != "Response" || violation.Sender == nil || !violation.Sender.ID.Equal(leafs[0]) {
+			t.Fatal("expected the leaf to be reported for its response, but got", violation)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the corrupted response wasn't reported to the root")
+	}
+	select {
+	case signature := <-cosiProtocol.FinalSignature:
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+		t.Fatal("the round should abort with a corrupted response, but produced a signature, verification:", err)
+	case <-time.After(time.Second):
+		log.Lvl2("round aborted as expected")
+	}
+}
+
+// Tests the parsing of the fault configuration of the toml files
+func TestFaultConfig(t *testing.T) {
+	for _, name := range []string{"drop", "delay", "duplicate", "reorder", "corrupt", "Drop"} {
+		action, err := fault.ParseAction(name)
+		if err != nil {
+			t.Fatal("couldn't parse action", name, ":", err)
+		}
+		if action.String() == "" {
+			t.Fatal("action", name, "should have a name, but hasn't")
+		}
+	}
+	if _, err := fault.ParseAction("explode"); err == nil {
+		t.Fatal("ParseAction should refuse an unknown action, but doesn't")
+	}
+
+	config := fault.Config{FaultMessage: "Challenge", FaultAction: "delay", FaultDelay: 20, FaultNodes: 1}
+	if !config.Enabled() {
+		t.Fatal("the configuration should be enabled, but isn't")
+	}
+	rule, err := config.Rule(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Message != "Challenge" || rule.Action != fault.Delay || rule.Delay != 20*time.Millisecond {
+		t.Fatal("the rule doesn't match the configuration")
+	}
+}
+
+// Tests that a node crashed in a round is left out of the signature of that round
+func TestFaultCrashedLeaf(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//the first leaf is crashed in round 1 only
+	leafs, err := protocol.GetLeafsIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		injector := fault.Install(s, local.Overlays[s.ServerIdentity.ID])
+		if s.ServerIdentity.ID.Equal(leafs[0]) {
+			injector.SetCrashed(func(round int) bool {
+				return round == 1
+			})
+		}
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.LeavesTimeout = 100 * time.Millisecond
+	cosiProtocol.Round = 1
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	var signature []byte
+	select {
+	case signature = <-cosiProtocol.FinalSignature:
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't get signature in time")
+	}
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: nNodes - 1})
+	if err != nil {
+		t.Fatal("didn't get a valid signature:", err)
+	}
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+	if err == nil {
+		t.Fatal("the crashed leaf should not be in the signature")
+	}
+}
+
+// Tests the crash schedules of the churn configuration
+func TestFaultChurn(t *testing.T) {
+	n := 100
+
+	//fractions of crashed servers from a schedule, the crashed sets being nested
+	churn := fault.Churn{ChurnSchedule: "0:0, 2:0.1, 4:0.3, 6:0", ChurnSeed: 7}
+	if !churn.Enabled() {
+		t.Fatal("the churn should be enabled, but isn't")
+	}
+	if err := churn.Check(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{0, 0, 9, 9, 29, 29, 0}
+	for round, count := range expected {
+		crashed := 0
+		for i := 0; i < n; i++ {
+			if churn.Crashed(i, n, round) {
+				crashed++
+				if round >= 4 && round < 6 && i > 0 && churn.Crashed(i, n, 2) && !churn.Crashed(i, n, round) {
+					t.Fatal("a server crashed with a smaller fraction should stay crashed")
+				}
+			}
+		}
+		if crashed != count {
+			t.Fatal("expected", count, "crashed servers in round", round, "but got", crashed)
+		}
+	}
+
+	//random crashes and recoveries, never the root, the same for the same seed
+	churn = fault.Churn{ChurnCrash: 0.2, ChurnRecover: 0.5, ChurnSeed: 3}
+	crashedOnce := false
+	for round := 0; round < 10; round++ {
+		if churn.Crashed(0, n, round) {
+			t.Fatal("the root should never crash")
+		}
+		for i := 1; i < n; i++ {
+			crashed := churn.Crashed(i, n, round)
+			if crashed != churn.Crashed(i, n, round) {
+				t.Fatal("the crashes should only depend on the seed")
+			}
+			crashedOnce = crashedOnce || crashed
+		}
+	}
+	if !crashedOnce {
+		t.Fatal("expected some crashes")
+	}
+
+	//invalid configurations
+	for _, schedule := range []string{"1", "a:0.1", "1:b", "1:2", "2:0.1, 1:0.2"} {
+		churn = fault.Churn{ChurnSchedule: schedule}
+		if err := churn.Check(); err == nil {
+			t.Fatal("the schedule", schedule, "should be refused, but isn't")
+		}
+	}
+	churn = fault.Churn{ChurnCrash: 1.5}
+	if err := churn.Check(); err == nil {
+		t.Fatal("a crash probability above 1 should be refused, but isn't")
+	}
+}
+
+// Tests that duplicated commitments and responses are counted once, so that
+// the signature still contains every node
+func TestFaultDuplicatedMessages(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//every node receives the commitments and responses twice
+	for _, s := range servers {
+		fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+			fault.Rule{Message: "Commitment", Action: fault.Duplicate},
+			fault.Rule{Message: "Response", Action: fault.Duplicate})
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.LeavesTimeout = time.Second
+	cosiProtocol.SubleaderTimeout = 2 * time.Second
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	err = getAndVerifySignature(cosiProtocol, publics, proposal, cosi.CompletePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a commitment whose mask claims other nodes is rejected, the signature
+// being produced without its sender, whether it is a leaf or a subleader
+func TestFaultForgedMask(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	nNodes := 16 //no padding bits in the mask, so the forged mask only enables existing nodes
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	for _, forgerIsSubleader := range []bool{false, true} {
+		local := onet.NewLocalTest()
+		servers, _, tree := local.GenTree(nNodes, false)
+		publics := make([]abstract.Point, tree.Size())
+		for i, node := range tree.List() {
+			publics[i] = node.ServerIdentity.Public
+		}
+
+		forgers, err := protocol.GetLeafsIDs(tree, nNodes, nSubtrees)
+		if forgerIsSubleader {
+			forgers, err = protocol.GetSubleaderIDs(tree, nNodes, nSubtrees)
+		}
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+		for _, s := range servers {
+			fault.Install(s, local.Overlays[s.ServerIdentity.ID], fault.Rule{Message: "Commitment",
+				Action: fault.ForgeMask, Senders: []network.ServerIdentityID{forgers[0]}})
+		}
+
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.LeavesTimeout = time.Second
+		cosiProtocol.SubleaderTimeout = 2 * time.Second
+		err = cosiProtocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		var signature []byte
+		select {
+		case signature = <-cosiProtocol.FinalSignature:
+		case <-time.After(10 * time.Second):
+			local.CloseAll()
+			t.Fatal("didn't get signature in time")
+		}
+		local.CloseAll()
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: nNodes - 1})
+		if err != nil {
+			t.Fatal("didn't get a valid signature:", err)
+		}
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+		if err == nil {
+			t.Fatal("the node forging its mask should not be in the signature")
+		}
+	}
+}
+
+// Tests that the leaves discard an announcement altered by their subleader,
+// which doesn't carry a valid signature of the root anymore
+func TestFaultForgedAnnouncement(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//the leaves receive another proposal from the first subleader
+	subleaders, err := protocol.GetSubleaderIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trees, err := protocol.GenTrees(tree.Roster, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nLeaves := len(trees[0].Root.Children[0].Children)
+	for _, s := range servers {
+		fault.Install(s, local.Overlays[s.ServerIdentity.ID], fault.Rule{Message: "Announcement",
+			Action: fault.Corrupt, Senders: []network.ServerIdentityID{subleaders[0]}})
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.LeavesTimeout = 200 * time.Millisecond
+	cosiProtocol.SubleaderTimeout = time.Second
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	var signature []byte
+	select {
+	case signature = <-cosiProtocol.FinalSignature:
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't get signature in time")
+	}
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: nNodes - nLeaves})
+	if err != nil {
+		t.Fatal("didn't get a valid signature:", err)
+	}
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: nNodes - nLeaves + 1})
+	if err == nil {
+		t.Fatal("the leaves should not sign the altered announcement")
+	}
+}
+
+// Tests that the leaves refuse a challenge replayed from an earlier run of the same
+// round on the same cached subtrees, as its signature binds the nonce of another announcement
+func TestFaultReplayedChallenge(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//the leaves of the first subtree get the challenge of the first run again in the second,
+	//and their subleader counts their responses
+	cache := protocol.NewTreeCache()
+	trees, err := cache.Trees(tree.Roster, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subleader := trees[0].Root.Children[0]
+	leaves := subleader.Children
+	var responses int32
+	for _, s := range servers {
+		injector := fault.Install(s, local.Overlays[s.ServerIdentity.ID])
+		for _, leaf := range leaves {
+			if leaf.ServerIdentity.ID.Equal(s.ServerIdentity.ID) {
+				injector.AddRule(fault.Rule{Message: "Challenge", Action: fault.Replay,
+					Senders: []network.ServerIdentityID{subleader.ServerIdentity.ID}})
+			}
+		}
+		if subleader.ServerIdentity.ID.Equal(s.ServerIdentity.ID) {
+			injector.SetObserver(func(e *network.Envelope, msg network.Message) {
+				if _, ok := msg.(*protocol.Response); ok {
+					atomic.AddInt32(&responses, 1)
+				}
+			})
+		}
+	}
+
+	for run := 0; run < 2; run++ {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.TreeCache = cache
+		cosiProtocol.ProtocolTimeout = 2 * time.Second
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		if run == 0 {
+			err = getAndVerifySignature(cosiProtocol, publics, proposal, cosi.CompletePolicy{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			atomic.StoreInt32(&responses, 0)
+			continue
+		}
+		select {
+		case <-cosiProtocol.FinalSignature:
+			t.Fatal("the round should abort without the responses of the leaves, but produced a signature")
+		case <-time.After(2 * cosiProtocol.ProtocolTimeout):
+		}
+		if n := atomic.LoadInt32(&responses); n != 0 {
+			t.Fatal("the leaves should refuse the replayed challenge, but", n, "responded")
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package protocol_tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// verifiedSubProtocolName is the subprotocol with the leader verification of the nodes,
+// as set by the service.
+const verifiedSubProtocolName = "SubCoSiVerified"
+
+// verifiedLeader and verifiedViolations are set by the tests before starting the verified subprotocol.
+var verifiedLeader protocol.LeaderVerifier
+var verifiedViolations chan protocol.Violation
+
+func init() {
+	onet.GlobalProtocolRegister(verifiedSubProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		pi, err := protocol.NewSubProtocol(n)
+		if err != nil {
+			return nil, err
+		}
+		subProtocol := pi.(*protocol.CoSiSubProtocolNode)
+		subProtocol.LeaderVerifier = verifiedLeader
+		subProtocol.ViolationReporter = func(v protocol.Violation) {
+			select {
+			case verifiedViolations <- v:
+			default:
+			}
+		}
+		return subProtocol, nil
+	})
+}
+
+// Tests that every server leads a round in turn
+func TestRoundRobinLeader(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+
+	nNodes := 5
+	_, roster, _ := local.GenTree(nNodes, false)
+
+	for round := 0; round < 3*nNodes; round++ {
+		leader, err := protocol.RoundRobinLeader(roster, round)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leader != round%nNodes {
+			t.Fatal("round", round, "should be led by", round%nNodes, "but is led by", leader)
+		}
+	}
+	if _, err := protocol.RoundRobinLeader(roster, -1); err == nil {
+		t.Fatal("RoundRobinLeader should refuse a negative round, but doesn't")
+	}
+	if _, err := protocol.RoundRobinLeader(nil, 1); err == nil {
+		t.Fatal("RoundRobinLeader should refuse a nil roster, but doesn't")
+	}
+}
+
+// Tests that the leader is moved first and the verifier only accepts the expected leader
+func TestRosterWithLeader(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+
+	nNodes := 5
+	_, roster, _ := local.GenTree(nNodes, false)
+
+	for leader := 0; leader < nNodes; leader++ {
+		rotated, err := protocol.RosterWithLeader(roster, leader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rotated.List) != nNodes {
+			t.Fatal("the rotated roster should have", nNodes, "servers, but has", len(rotated.List))
+		}
+		if !rotated.List[0].ID.Equal(roster.List[leader].ID) {
+			t.Fatal("the leader should be the first server of the rotated roster, but isn't")
+		}
+		trees, err := protocol.GenTrees(rotated, nNodes, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !trees[0].Root.ServerIdentity.ID.Equal(roster.List[leader].ID) {
+			t.Fatal("the leader should be the root of the generated trees, but isn't")
+		}
+	}
+
+	verifier := protocol.RoundRobinVerifier(roster)
+	if err := verifier(2, roster.List[2]); err != nil {
+		t.Fatal("the verifier should accept the expected leader, but refuses it:", err)
+	}
+	if err := verifier(2, roster.List[3]); err == nil {
+		t.Fatal("the verifier should refuse an unexpected leader, but doesn't")
+	}
+	forged := *roster.List[2]
+	forged.Public = roster.List[3].Public
+	if err := verifier(2, &forged); err == nil {
+		t.Fatal("the verifier should refuse the expected leader with another key, but doesn't")
+	}
+	if err := verifier(0, roster.List[0]); err != nil {
+		t.Fatal("the verifier should accept the first server in round zero, but refuses it:", err)
+	}
+	if err := verifier(0, roster.List[3]); err == nil {
+		t.Fatal("the verifier should refuse an unexpected leader in round zero, but doesn't")
+	}
+}
+
+// Tests that the nodes refuse the announcement of a subleader re-rooting the tree at itself,
+// although it signs the announcement with the key of the root of its tree
+func TestReRootedTree(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+
+	nNodes := 5
+	_, roster, _ := local.GenTree(nNodes, false)
+
+	//the subleader takes the place of the leader of round zero, the first server
+	subleader := roster.List[1]
+	forged := onet.NewRoster(append([]*network.ServerIdentity{subleader}, roster.List[2:]...))
+	tree := forged.GenerateNaryTree(len(forged.List) - 1)
+	publics := make([]abstract.Point, len(forged.List))
+	for i, si := range forged.List {
+		publics[i] = si.Public
+	}
+
+	verifiedLeader = protocol.RoundRobinVerifier(roster)
+	verifiedViolations = make(chan protocol.Violation, nNodes)
+	pi, err := local.CreateProtocol(verifiedSubProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	subProtocol := pi.(*protocol.CoSiSubProtocolNode)
+	subProtocol.Publics = publics
+	subProtocol.Proposal = []byte{0xFF}
+	subProtocol.Round = 0
+	err = subProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	for i := 1; i < len(forged.List); i++ {
+		select {
+		case violation := <-verifiedViolations:
+			if violation.Message != "Announcement" || !violation.Sender.ID.Equal(subleader.ID) ||
+				!strings.Contains(violation.Reason, "should be led by") {
+				t.Fatal("expected the announcement of the subleader to be refused, but got", violation)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("only", i-1, "of the", len(forged.List)-1, "nodes refused the announcement of the subleader")
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package protocol_tests
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// Tests that starting and shutting down the protocols concurrently, many times,
+// neither panics nor leaves goroutines behind. Meant to be run with -race.
+func TestLifecycleConcurrentStartShutdown(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 5
+	nInstances := 50
+	proposal := []byte{0xFF}
+
+	_, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+	subtree, err := protocol.GenSubtree(tree.Roster, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < nInstances; i++ {
+		//root protocol
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		root := pi.(*protocol.CoSiRootNode)
+		root.CreateProtocol = local.CreateProtocol
+		root.Proposal = proposal
+		root.NSubtrees = 2
+
+		//subprotocol alone
+		pi, err = local.CreateProtocol(protocol.SubProtocolName, subtree)
+		if err != nil {
+			t.Fatal("Error in creation of subprotocol:", err)
+		}
+		sub := pi.(*protocol.CoSiSubProtocolNode)
+		sub.Proposal = proposal
+		sub.Publics = publics
+
+		wg.Add(6)
+		go func() {
+			defer wg.Done()
+			root.Start()
+		}()
+		go func() {
+			defer wg.Done()
+			root.Shutdown()
+		}()
+		go func() {
+			defer wg.Done()
+			root.Shutdown()
+		}()
+		go func() {
+			defer wg.Done()
+			sub.Start()
+		}()
+		go func() {
+			defer wg.Done()
+			sub.Shutdown()
+		}()
+		go func() {
+			defer wg.Done()
+			sub.HandleStop(protocol.StructStop{TreeNode: sub.TreeNode(), Stop: protocol.Stop{}})
+		}()
+	}
+	wg.Wait()
+
+	err = waitProtocolGoroutines(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that Start doesn't block and refuses a second start or a start after shutdown
+func TestLifecycleStart(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	proposal := []byte{0xFF}
+	_, _, tree := local.GenTree(5, false)
+
+	for _, shutdownFirst := range []bool{false, true} {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		root := pi.(*protocol.CoSiRootNode)
+		root.CreateProtocol = local.CreateProtocol
+		root.Proposal = proposal
+
+		if shutdownFirst {
+			root.Shutdown()
+			if root.Start() == nil {
+				t.Fatal("a stopped protocol should not start")
+			}
+			continue
+		}
+
+		started := make(chan error, 2)
+		go func() {
+			started <- root.Start()
+			started <- root.Start()
+		}()
+		for i := 0; i < 2; i++ {
+			select {
+			case err = <-started:
+				if i == 0 && err != nil {
+					t.Fatal("Error in starting of protocol:", err)
+				}
+				if i == 1 && err == nil {
+					t.Fatal("the protocol should not start twice")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Start blocked")
+			}
+		}
+		select {
+		case <-root.FinalSignature:
+		case <-time.After(10 * time.Second):
+			t.Fatal("didn't get signature in time")
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests the suspicion level of nodes sending regular heartbeats, then stopping
+func TestFailureDetector(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(3, false)
+	alive := tree.List()[1].ServerIdentity.ID
+	dead := tree.List()[2].ServerIdentity.ID
+
+	interval := 100 * time.Millisecond
+	detector := protocol.NewFailureDetector(interval)
+	start := time.Now()
+	detector.Watch(alive, start)
+	detector.Watch(dead, start)
+	for i := 1; i <= 10; i++ {
+		detector.Heartbeat(alive, start.Add(time.Duration(i)*interval))
+	}
+	last := start.Add(10 * interval)
+
+	if phi := detector.Phi(alive, last.Add(interval)); phi > 1 {
+		t.Fatal("expected a low suspicion one interval after the last heartbeat, but got", phi)
+	}
+	if phi := detector.Phi(alive, last.Add(10*interval)); phi < protocol.DefaultPhiThreshold {
+		t.Fatal("expected a node missing ten heartbeats to be suspected, but phi is", phi)
+	}
+	if phi := detector.Phi(dead, start.Add(10*interval)); phi < protocol.DefaultPhiThreshold {
+		t.Fatal("expected a node never sending heartbeats to be suspected, but phi is", phi)
+	}
+	if phi := detector.Phi(tree.List()[0].ServerIdentity.ID, last.Add(time.Hour)); phi != 0 {
+		t.Fatal("expected no suspicion of a node not watched, but phi is", phi)
+	}
+
+	//the roster without the suspected node, the root being always kept
+	roster := detector.Alive(tree.Roster, tree.Size())
+	if len(roster.List) != 2 || !roster.List[0].ID.Equal(tree.Roster.List[0].ID) {
+		t.Fatal("expected the root and one node to be alive, but got", len(roster.List), "nodes")
+	}
+}
+
+// Tests that a dead subleader detected by the liveness monitor is left out of the
+// subtrees, so that the round doesn't wait for it
+func TestLivenessMonitor(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 3
+	subleaderTimeout := 5 * time.Second
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//a subleader is dead
+	subleaders, err := protocol.GetSubleaderIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := subleaders[0]
+	for _, s := range servers {
+		if s.ServerIdentity.ID.Equal(dead) {
+			fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+				fault.Rule{Message: "Announcement", Action: fault.Drop},
+				fault.Rule{Message: "Ping", Action: fault.Drop})
+		}
+	}
+
+	monitor, err := protocol.NewLivenessMonitor(tree.Roster, local.CreateProtocol, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.Start()
+	defer monitor.Stop()
+
+	deadline := time.After(5 * time.Second)
+	for !monitor.Detector.Suspected(dead) {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("the dead subleader wasn't suspected in time")
+		}
+	}
+	for _, node := range tree.List()[1:] {
+		if !node.ServerIdentity.ID.Equal(dead) && monitor.Detector.Suspected(node.ServerIdentity.ID) {
+			t.Fatal("a node answering the pings is suspected")
+		}
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = []byte{0xFF}
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.SubleaderTimeout = subleaderTimeout
+	cosiProtocol.LeavesTimeout = subleaderTimeout / 2
+	cosiProtocol.FailureDetector = monitor.Detector
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	var signature []byte
+	select {
+	case signature = <-cosiProtocol.FinalSignature:
+	case <-time.After(subleaderTimeout):
+		t.Fatal("didn't get signature before the subleader timeout")
+	}
+	err = cosi.Verify(network.Suite, publics, []byte{0xFF}, signature, cosi.ThresholdPolicy{T: nNodes - 1})
+	if err != nil {
+		t.Fatal("didn't get a valid signature:", err)
+	}
+	if cosiProtocol.Stats.SubleaderRestarts != 0 {
+		t.Fatal("expected no subleader restart, but got", cosiProtocol.Stats.SubleaderRestarts)
+	}
+}
@@ -0,0 +1,125 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests that the root sends the challenge as soon as the policy is met,
+// without waiting for a slow subtree
+func TestPolicyEarlyTermination(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	threshold := 6 //the root and the first subtree
+	proposal := []byte{0xFF}
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//delay the commitment of the second subleader
+	subleaders, err := protocol.GetSubleaderIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		fault.Install(s, local.Overlays[s.ServerIdentity.ID], fault.Rule{Message: "Commitment",
+			Action: fault.Delay, Delay: 5 * time.Second, Senders: []network.ServerIdentityID{subleaders[1]}})
+	}
+
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.SubleaderTimeout = 10 * time.Second
+	cosiProtocol.Policy = cosi.ThresholdPolicy{T: threshold}
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	var signature []byte
+	select {
+	case signature = <-cosiProtocol.FinalSignature:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the root waited for the slow subtree")
+	}
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: threshold})
+	if err != nil {
+		t.Fatal("didn't get a valid signature:", err)
+	}
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+	if err == nil {
+		t.Fatal("the slow subtree should not be in the signature")
+	}
+}
+
+// Tests that the root aborts once the policy cannot be met anymore
+func TestPolicyUnattainable(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	nNodes := 10
+	nSubtrees := 2
+	proposal := []byte{0xFF}
+
+	for _, threshold := range []int{nNodes + 1, nNodes - 1} {
+		local := onet.NewLocalTest()
+		servers, _, tree := local.GenTree(nNodes, false)
+
+		//two leaves don't respond
+		leafs, err := protocol.GetLeafsIDs(tree, nNodes, nSubtrees)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+		for _, s := range servers {
+			if s.ServerIdentity.ID.Equal(leafs[0]) || s.ServerIdentity.ID.Equal(leafs[1]) {
+				fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+					fault.Rule{Message: "Announcement", Action: fault.Drop})
+			}
+		}
+
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.SubleaderTimeout = time.Second
+		cosiProtocol.LeavesTimeout = 100 * time.Millisecond
+		cosiProtocol.Policy = cosi.ThresholdPolicy{T: threshold}
+		err = cosiProtocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		select {
+		case <-cosiProtocol.FinalSignature:
+			local.CloseAll()
+			t.Fatal("the root should abort with a threshold of", threshold, "but produced a signature")
+		case <-time.After(2 * time.Second):
+		}
+		local.CloseAll()
+	}
+}
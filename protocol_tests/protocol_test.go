@@ -9,6 +9,7 @@ import (
 	"gopkg.in/dedis/onet.v1/network"
 	"github.com/dedis/student_17_bftcosi/cosi"
 	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
 	"time"
 	"fmt"
 )
@@ -62,6 +63,43 @@ func TestProtocol(t *testing.T) {
 	}
 }
 
+// Tests a multi-megabyte random proposal
+func TestLargeProposal(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	proposal := random.Bytes(4*1024*1024, random.Stream)
+
+	_, _, tree := local.GenTree(24, false)
+
+	//get public keys
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//start protocol
+	pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = local.CreateProtocol
+	cosiProtocol.Proposal = proposal
+	cosiProtocol.NSubtrees = 4
+	err = cosiProtocol.Start()
+	if err != nil {
+		t.Fatal("Error in starting of protocol:", err)
+	}
+
+	//get and verify signature
+	err = getAndVerifySignature(cosiProtocol, publics, proposal, cosi.CompletePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Tests unresponsive leaves in various tree configurations
 func TestUnresponsiveLeafs(t *testing.T) {
 	//log.SetDebugVisible(3)
@@ -0,0 +1,96 @@
+package protocol_tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests that the cache returns the lists by their hash and evicts the oldest one
+func TestPublicsCache(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(5, false)
+
+	var lists [][]abstract.Point
+	for _, node := range tree.List() {
+		lists = append(lists, []abstract.Point{node.ServerIdentity.Public})
+	}
+
+	cache := protocol.NewPublicsCache(len(lists) - 1)
+	var hashes [][]byte
+	for _, list := range lists {
+		hash, err := cache.Add(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := protocol.HashPublics(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash, expected) {
+			t.Fatal("the cache returned another hash than HashPublics")
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if cache.Get(hashes[0]) != nil {
+		t.Fatal("the oldest list should have been evicted")
+	}
+	for i := 1; i < len(lists); i++ {
+		publics := cache.Get(hashes[i])
+		if len(publics) != 1 || !publics[0].Equal(lists[i][0]) {
+			t.Fatal("the cache didn't return the list", i)
+		}
+	}
+}
+
+// Tests that the nodes sign a second round with the public keys cached during the first one
+func TestPublicsCachedRounds(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+
+	_, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	for round, proposal := range [][]byte{{0x01}, {0x02}} {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.LeavesTimeout = time.Second
+		cosiProtocol.SubleaderTimeout = 2 * time.Second
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		var signature []byte
+		select {
+		case signature = <-cosiProtocol.FinalSignature:
+		case <-time.After(10 * time.Second):
+			t.Fatal("didn't get signature in time in round", round)
+		}
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+		if err != nil {
+			t.Fatal("didn't get a valid signature in round", round, ":", err)
+		}
+	}
+}
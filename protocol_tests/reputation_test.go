@@ -0,0 +1,214 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests the scores, the subleader role and the exclusion of the nodes
+func TestReputationTable(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(4, false)
+	servers := tree.Roster.List
+
+	table := protocol.NewReputationTable()
+	table.Exclude = true
+	if table.Score(servers[1].ID) != 1 || !table.CanLead(servers[1].ID) {
+		t.Fatal("a node without record should have a perfect reputation")
+	}
+
+	table.Record(servers[1], protocol.Signed)
+	table.Record(servers[2], protocol.Absent)
+	table.Record(servers[2], protocol.Absent)
+	table.Record(servers[3], protocol.Misbehaved)
+	table.Record(servers[3], protocol.Misbehaved)
+	table.Record(servers[3], protocol.Misbehaved)
+	if score := table.Score(servers[2].ID); score != 0.5625 {
+		t.Fatal("expected a score of 0.5625 after two absences, but got", score)
+	}
+	if !table.CanLead(servers[2].ID) {
+		t.Fatal("a node absent twice should still lead")
+	}
+	table.Record(servers[2], protocol.Absent)
+	if table.CanLead(servers[2].ID) || table.Excluded(servers[2].ID) {
+		t.Fatal("a node absent three times shouldn't lead, but should stay in the subtrees")
+	}
+	if !table.Excluded(servers[3].ID) {
+		t.Fatal("a node misbehaving three times should be excluded")
+	}
+
+	reputations := table.Reputations()
+	if len(reputations) != 3 || !reputations[0].Server.ID.Equal(servers[3].ID) || reputations[0].Misbehaved != 3 {
+		t.Fatal("expected the misbehaving node first in the reputations")
+	}
+
+	//the excluded node is left out of the roster, and recovers over the rounds
+	roster := table.Allowed(tree.Roster, len(servers))
+	if len(roster.List) != 3 {
+		t.Fatal("expected the excluded node to be left out, but got", len(roster.List), "nodes")
+	}
+	for round := 0; round < 10 && table.Excluded(servers[3].ID); round++ {
+		table.Allowed(tree.Roster, len(servers))
+	}
+	if table.Excluded(servers[3].ID) {
+		t.Fatal("the excluded node didn't recover")
+	}
+	if roster = table.Allowed(tree.Roster, len(servers)); roster != tree.Roster {
+		t.Fatal("expected the roster to be kept without excluded node")
+	}
+}
+
+// Tests that a subleader failing in every round stops being chosen as subleader
+func TestReputationSubleader(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 3
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	subleaders, err := protocol.GetSubleaderIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := subleaders[0]
+	for _, s := range servers {
+		if s.ServerIdentity.ID.Equal(failing) {
+			fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+				fault.Rule{Message: "Announcement", Action: fault.Drop})
+		}
+	}
+
+	table := protocol.NewReputationTable()
+	for round, proposal := range [][]byte{{0x01}, {0x02}, {0x03}, {0x04}} {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.SubleaderTimeout = 500 * time.Millisecond
+		cosiProtocol.LeavesTimeout = 250 * time.Millisecond
+		cosiProtocol.Reputation = table
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		var signature []byte
+		select {
+		case signature = <-cosiProtocol.FinalSignature:
+		case <-time.After(10 * time.Second):
+			t.Fatal("didn't get signature in time in round", round)
+		}
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: nNodes - 1})
+		if err != nil {
+			t.Fatal("didn't get a valid signature in round", round, ":", err)
+		}
+
+		//three absences make the subleader lose its role
+		restarts := cosiProtocol.Stats.SubleaderRestarts
+		if round < 3 && restarts != 1 {
+			t.Fatal("expected the failing subleader to be restarted in round", round, "but got", restarts, "restart(s)")
+		}
+		if round == 3 && restarts != 0 {
+			t.Fatal("expected the failing node not to be subleader anymore, but got", restarts, "restart(s)")
+		}
+	}
+
+	for _, reputation := range table.Reputations() {
+		if reputation.Server.ID.Equal(failing) {
+			if reputation.Absent != 4 || reputation.Signed != 0 {
+				t.Fatal("expected the failing node to be absent in every round, but got", reputation.Absent)
+			}
+		} else if reputation.Signed != 4 {
+			t.Fatal("expected the other nodes to sign in every round, but got", reputation.Signed)
+		}
+	}
+}
+
+// Tests that a leaf corrupting its responses is recorded as misbehaving in every round,
+// until it is excluded
+func TestReputationCorruptingLeaf(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	leafs, err := protocol.GetLeafsIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupting := leafs[0]
+	for _, s := range servers {
+		fault.Install(s, local.Overlays[s.ServerIdentity.ID], fault.Rule{Message: "Response",
+			Action: fault.Corrupt, Senders: []network.ServerIdentityID{corrupting}})
+	}
+
+	table := protocol.NewReputationTable()
+	table.Exclude = true
+	for round, proposal := range [][]byte{{0x01}, {0x02}, {0x03}} {
+		if table.Excluded(corrupting) {
+			t.Fatal("the corrupting leaf is excluded before round", round)
+		}
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.ProtocolTimeout = 5 * time.Second
+		cosiProtocol.Reputation = table
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		//the round aborts at once, the outcomes being recorded when it returns
+		deadline := time.Now().Add(3 * time.Second)
+		for misbehaved(table, corrupting) != round+1 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the leaf to misbehave", round+1, "time(s), but got", misbehaved(table, corrupting))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if !table.Excluded(corrupting) {
+		t.Fatal("the corrupting leaf should be excluded after three rounds")
+	}
+	if roster := table.Allowed(tree.Roster, nNodes); len(roster.List) != nNodes-1 {
+		t.Fatal("expected the corrupting leaf to be left out of the roster, but got", len(roster.List), "nodes")
+	}
+}
+
+// misbehaved returns the number of misbehaviours recorded for the node.
+func misbehaved(table *protocol.ReputationTable, id network.ServerIdentityID) int {
+	for _, reputation := range table.Reputations() {
+		if reputation.Server.ID.Equal(id) {
+			return reputation.Misbehaved
+		}
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests the number of subtrees chosen with the default and extreme costs
+func TestAutoSubtrees(t *testing.T) {
+	for _, n := range []int{1, 2} {
+		if k := protocol.AutoSubtrees(n, protocol.DefaultFanoutCost, protocol.DefaultRTT); k != 1 {
+			t.Fatal("expected one subtree for", n, "nodes, but got", k)
+		}
+	}
+
+	//around the square root of the number of nodes
+	for _, n := range []int{100, 500, 1000} {
+		k := protocol.AutoSubtrees(n, protocol.DefaultFanoutCost, protocol.DefaultRTT)
+		if k*k < n/4 || k*k > n*4 {
+			t.Fatal("expected around sqrt(n) subtrees for", n, "nodes, but got", k)
+		}
+	}
+
+	//a star when the round-trip time is larger than sending to every node
+	k := protocol.AutoSubtrees(100, protocol.DefaultFanoutCost, time.Second)
+	if k != 99 {
+		t.Fatal("expected a star with a large round-trip time, but got", k, "subtrees")
+	}
+
+	//a single subtree when sending is expensive
+	k = protocol.AutoSubtrees(100, time.Second, time.Millisecond)
+	if k > 10 {
+		t.Fatal("expected few subtrees with an expensive fan-out, but got", k)
+	}
+}
+
+// Tests that the cost model follows the measures, but keeps its choice when
+// the new one is only slightly better
+func TestCostModel(t *testing.T) {
+	nNodes := 100
+	model := protocol.NewCostModel()
+	first := model.Subtrees(nNodes)
+	if first != protocol.AutoSubtrees(nNodes, protocol.DefaultFanoutCost, protocol.DefaultRTT) {
+		t.Fatal("expected the model to use the default costs without measures, but got", first)
+	}
+
+	//around 90ms, a star is only slightly better
+	for i := 0; i < 40; i++ {
+		model.ObserveRTT(90 * time.Millisecond)
+	}
+	if protocol.AutoSubtrees(nNodes, protocol.DefaultFanoutCost, 89*time.Millisecond) == first {
+		t.Fatal("expected another number of subtrees to be better around 90ms")
+	}
+	if k := model.Subtrees(nNodes); k != first {
+		t.Fatal("expected the model to keep", first, "subtrees, but got", k)
+	}
+
+	//a much larger round-trip time makes a star clearly better
+	for i := 0; i < 40; i++ {
+		model.ObserveRTT(time.Second)
+	}
+	if k := model.Subtrees(nNodes); k != nNodes-1 {
+		t.Fatal("expected a star with a large round-trip time, but got", k, "subtrees")
+	}
+}
+
+// Tests that the root chooses the number of subtrees when it is zero
+func TestProtocolAutoSubtrees(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+
+	_, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+	expected := protocol.AutoSubtrees(nNodes, protocol.DefaultFanoutCost, protocol.DefaultRTT)
+
+	model := protocol.NewCostModel()
+	for round, proposal := range [][]byte{{0x01}, {0x02}} {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = 0
+		cosiProtocol.CostModel = model
+		cosiProtocol.LeavesTimeout = 2 * time.Second
+		cosiProtocol.SubleaderTimeout = 4 * time.Second
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		var signature []byte
+		select {
+		case signature = <-cosiProtocol.FinalSignature:
+		case <-time.After(10 * time.Second):
+			t.Fatal("didn't get signature in time in round", round)
+		}
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.CompletePolicy{})
+		if err != nil {
+			t.Fatal("didn't get a valid signature in round", round, ":", err)
+		}
+		if round == 0 && cosiProtocol.Stats.NSubtrees != expected {
+			t.Fatal("expected", expected, "subtrees, but got", cosiProtocol.Stats.NSubtrees)
+		}
+		if cosiProtocol.Stats.NSubtrees < 1 {
+			t.Fatal("expected at least one subtree, but got", cosiProtocol.Stats.NSubtrees)
+		}
+	}
+}
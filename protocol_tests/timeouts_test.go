@@ -0,0 +1,131 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests the timeouts derived from the samples and their bounds
+func TestTimeoutEstimator(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(11, false)
+	nodes := tree.List()
+
+	estimator := protocol.NewTimeoutEstimator()
+	_, _, ok := estimator.Timeouts()
+	if ok {
+		t.Fatal("the estimator should fall back to the static timeouts without samples")
+	}
+
+	//ten leaves from 10ms to 100ms, the 95th percentile being 100ms
+	for i := 1; i <= 10; i++ {
+		estimator.ObserveLeaf(nodes[i].ServerIdentity.Public, time.Duration(i)*10*time.Millisecond)
+	}
+	estimator.ObserveSubtree(nodes[1].ServerIdentity.Public, 300*time.Millisecond)
+
+	subleader, leaves, ok := estimator.Timeouts()
+	if !ok {
+		t.Fatal("the estimator should derive timeouts once a subtree committed")
+	}
+	if leaves != 200*time.Millisecond {
+		t.Fatal("expected a leaves timeout of 200ms, but got", leaves)
+	}
+	if subleader != 600*time.Millisecond {
+		t.Fatal("expected a subleader timeout of 600ms, but got", subleader)
+	}
+
+	//bounds
+	estimator.Max = 400 * time.Millisecond
+	estimator.Min = 250 * time.Millisecond
+	subleader, leaves, _ = estimator.Timeouts()
+	if leaves != 250*time.Millisecond || subleader != 400*time.Millisecond {
+		t.Fatal("expected bounded timeouts of 400ms and 250ms, but got", subleader, "and", leaves)
+	}
+
+	//only the recent samples are kept
+	estimator.Min, estimator.Max = 0, 0
+	for i := 0; i < protocol.DefaultTimeoutWindow; i++ {
+		estimator.ObserveSubtree(nodes[1].ServerIdentity.Public, 50*time.Millisecond)
+	}
+	subleader, _, _ = estimator.Timeouts()
+	if subleader != 250*time.Millisecond {
+		t.Fatal("expected a subleader timeout of 250ms from the recent samples, but got", subleader)
+	}
+}
+
+// Tests that the second round uses a leaves timeout derived from the first one,
+// shorter than the static one the leaves wait for when a leaf fails
+func TestAdaptiveTimeouts(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+	staticLeavesTimeout := 2 * time.Second
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	//a leaf never commits
+	leafs, err := protocol.GetLeafsIDs(tree, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		if s.ServerIdentity.ID.Equal(leafs[0]) {
+			fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+				fault.Rule{Message: "Announcement", Action: fault.Drop})
+		}
+	}
+
+	estimator := protocol.NewTimeoutEstimator()
+	estimator.Min = 500 * time.Millisecond //leaves the other leaves enough time in a loaded test
+	for round, proposal := range [][]byte{{0x01}, {0x02}} {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = proposal
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.LeavesTimeout = staticLeavesTimeout
+		cosiProtocol.SubleaderTimeout = 2 * staticLeavesTimeout
+		cosiProtocol.Timeouts = estimator
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		var signature []byte
+		select {
+		case signature = <-cosiProtocol.FinalSignature:
+		case <-time.After(10 * time.Second):
+			t.Fatal("didn't get signature in time in round", round)
+		}
+		err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: nNodes - 1})
+		if err != nil {
+			t.Fatal("didn't get a valid signature in round", round, ":", err)
+		}
+
+		leavesTimeout := cosiProtocol.Stats.LeavesTimeout
+		if round == 0 && leavesTimeout != staticLeavesTimeout {
+			t.Fatal("expected the static leaves timeout in the first round, but got", leavesTimeout)
+		}
+		if round == 1 && leavesTimeout >= staticLeavesTimeout {
+			t.Fatal("expected a shorter leaves timeout in the second round, but got", leavesTimeout)
+		}
+	}
+}
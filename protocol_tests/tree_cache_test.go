@@ -0,0 +1,174 @@
+package protocol_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests that the cache returns the same trees until a subtree is replaced or removed
+func TestTreeCache(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 3
+	_, roster, _ := local.GenTree(nNodes, false)
+
+	cache := protocol.NewTreeCache()
+	first, err := cache.Trees(roster, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.Trees(roster, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != nSubtrees || len(second) != nSubtrees {
+		t.Fatal("expected", nSubtrees, "subtrees, but got", len(first), "and", len(second))
+	}
+	for i := range first {
+		if first[i].ID != second[i].ID {
+			t.Fatal("the cache generated new trees")
+		}
+	}
+
+	//another number of subtrees gives other trees
+	other, err := cache.Trees(roster, nNodes, nSubtrees-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other[0].ID == first[0].ID {
+		t.Fatal("the cache returned the trees of another number of subtrees")
+	}
+
+	//replace the subleader of the first subtree
+	subtree, err := protocol.GenSubtree(first[0].Roster, first[0].Root.Children[0].RosterIndex+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Replace(first[0], subtree)
+	replaced, err := cache.Trees(roster, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced[0].ID != subtree.ID || replaced[1].ID != first[1].ID {
+		t.Fatal("only the first subtree should have been replaced")
+	}
+
+	//remove the trees
+	cache.Remove(subtree)
+	removed, err := cache.Trees(roster, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed[1].ID == first[1].ID {
+		t.Fatal("the trees should have been generated again")
+	}
+}
+
+// Tests that the cache keeps the trees used most recently, evicting the others
+func TestTreeCacheEviction(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	_, roster, _ := local.GenTree(nNodes, false)
+
+	cache := protocol.NewTreeCache()
+	cache.Size = 2
+	first := make(map[int]onet.TreeID)
+	for _, nSubtrees := range []int{2, 3, 2, 4} { //the trees of 3 subtrees are the least recently used
+		trees, err := cache.Trees(roster, nNodes, nSubtrees)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := first[nSubtrees]; !ok {
+			first[nSubtrees] = trees[0].ID
+		}
+	}
+
+	for _, nSubtrees := range []int{2, 4} {
+		trees, err := cache.Trees(roster, nNodes, nSubtrees)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trees[0].ID != first[nSubtrees] {
+			t.Fatal("the trees of", nSubtrees, "subtrees were used recently and should be kept")
+		}
+	}
+	trees, err := cache.Trees(roster, nNodes, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trees[0].ID == first[3] {
+		t.Fatal("the trees of 3 subtrees were used the longest ago and should be evicted")
+	}
+}
+
+// Tests that the next round starts with the subleader that replaced a failing one
+func TestTreeCacheSubleaderReplaced(t *testing.T) {
+	//log.SetDebugVisible(3)
+
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	nNodes := 10
+	nSubtrees := 2
+
+	servers, _, tree := local.GenTree(nNodes, false)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	cache := protocol.NewTreeCache()
+	trees, err := cache.Trees(tree.Roster, nNodes, nSubtrees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := trees[0].Root.Children[0].ServerIdentity.ID
+	for _, s := range servers {
+		if s.ServerIdentity.ID.Equal(failing) {
+			fault.Install(s, local.Overlays[s.ServerIdentity.ID],
+				fault.Rule{Message: "Announcement", Action: fault.Drop})
+		}
+	}
+
+	for round, restarts := range []int{1, 0} {
+		pi, err := local.CreateProtocol(protocol.ProtocolName, tree)
+		if err != nil {
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		cosiProtocol := pi.(*protocol.CoSiRootNode)
+		cosiProtocol.CreateProtocol = local.CreateProtocol
+		cosiProtocol.Proposal = []byte{byte(round)}
+		cosiProtocol.NSubtrees = nSubtrees
+		cosiProtocol.TreeCache = cache
+		cosiProtocol.LeavesTimeout = 200 * time.Millisecond
+		cosiProtocol.SubleaderTimeout = time.Second
+		err = cosiProtocol.Start()
+		if err != nil {
+			t.Fatal("Error in starting of protocol:", err)
+		}
+
+		var signature []byte
+		select {
+		case signature = <-cosiProtocol.FinalSignature:
+		case <-time.After(10 * time.Second):
+			t.Fatal("didn't get signature in time in round", round)
+		}
+		err = cosi.Verify(network.Suite, publics, cosiProtocol.Proposal, signature,
+			cosi.ThresholdPolicy{T: nNodes - 1})
+		if err != nil {
+			t.Fatal("didn't get a valid signature in round", round, ":", err)
+		}
+		if cosiProtocol.Stats.SubleaderRestarts != restarts {
+			t.Fatal("expected", restarts, "subleader restarts in round", round, "but got",
+				cosiProtocol.Stats.SubleaderRestarts)
+		}
+	}
+}
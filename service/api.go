@@ -0,0 +1,149 @@
+package service
+
+/*
+The api.go defines the methods that can be called from the outside. Most
+of the methods will take a roster so that the service knows which nodes
+it should work with.
+*/
+
+import (
+	"errors"
+
+	"github.com/dedis/student_17_bftcosi/ledger"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Client is a structure to communicate with the CoSi service
+type Client struct {
+	*onet.Client
+}
+
+// NewClient instantiates a new CoSi service client
+func NewClient() *Client {
+	return &Client{Client: onet.NewClient(ServiceName)}
+}
+
+// SignatureRequest asks the first server of the roster to collectively sign
+// the message with the other servers of the roster.
+// A zero policy requires the signature of every server.
+func (c *Client) SignatureRequest(roster *onet.Roster, message []byte, nSubtrees, policy int) (*SignatureResponse, onet.ClientError) {
+	if roster == nil || len(roster.List) < 1 {
+		return nil, onet.NewClientError(errors.New("got an empty roster"))
+	}
+	dst := roster.List[0]
+	request := &SignatureRequest{
+		Roster:    roster,
+		Message:   message,
+		NSubtrees: nSubtrees,
+		Policy:    policy,
+	}
+	response := &SignatureResponse{}
+	err := c.SendProtobuf(dst, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// StoreBlock asks the leader of the next round to append a block containing
+// the payload to the ledger, collectively signed by the roster.
+func (c *Client) StoreBlock(roster *onet.Roster, payload []byte, nSubtrees, policy int) (*ledger.Block, onet.ClientError) {
+	leader, err := c.nextLeader(roster)
+	if err != nil {
+		return nil, err
+	}
+	request := &StoreBlockRequest{
+		Roster:    roster,
+		Payload:   payload,
+		NSubtrees: nSubtrees,
+		Policy:    policy,
+	}
+	response := &StoreBlockResponse{}
+	err = c.SendProtobuf(leader, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Block, nil
+}
+
+// GetBlocks asks a server for the blocks of its ledger with heights in [start, end[.
+func (c *Client) GetBlocks(dst *network.ServerIdentity, start, end int) ([]*ledger.Block, onet.ClientError) {
+	response := &GetBlocksResponse{}
+	err := c.SendProtobuf(dst, &GetBlocksRequest{start, end}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Blocks, nil
+}
+
+// EpochChange asks the leader of the next round to make the roster sign a
+// forward link to the new roster, which will sign the following blocks.
+func (c *Client) EpochChange(roster, newRoster *onet.Roster, nSubtrees, policy int) (*ledger.ForwardLink, onet.ClientError) {
+	leader, err := c.nextLeader(roster)
+	if err != nil {
+		return nil, err
+	}
+	request := &EpochChangeRequest{
+		Roster:    roster,
+		NewRoster: newRoster,
+		NSubtrees: nSubtrees,
+		Policy:    policy,
+	}
+	response := &EpochChangeResponse{}
+	err = c.SendProtobuf(leader, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Link, nil
+}
+
+// GetForwardLinks asks a server for the genesis roster and the forward links of its ledger.
+// A light client can then verify them with ledger.FollowForwardLinks to learn the
+// current roster, or with ledger.VerifyEpochChain to verify blocks of any epoch.
+func (c *Client) GetForwardLinks(dst *network.ServerIdentity) (*onet.Roster, []*ledger.ForwardLink, onet.ClientError) {
+	response := &GetForwardLinksResponse{}
+	err := c.SendProtobuf(dst, &GetForwardLinksRequest{}, response)
+	if err != nil {
+		return nil, nil, err
+	}
+	return response.Genesis, response.Links, nil
+}
+
+// Reputation asks a server for the reputation of the nodes of the rounds it led,
+// from the lowest score to the highest.
+func (c *Client) Reputation(dst *network.ServerIdentity) ([]protocol.Reputation, onet.ClientError) {
+	response := &ReputationResponse{}
+	err := c.SendProtobuf(dst, &ReputationRequest{}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Reputations, nil
+}
+
+// nextLeader returns the server leading the next round of the ledger.
+// Since blocks are propagated asynchronously, the height of the ledger is
+// the highest one returned by the servers of the roster.
+func (c *Client) nextLeader(roster *onet.Roster) (*network.ServerIdentity, onet.ClientError) {
+	if roster == nil || len(roster.List) < 1 {
+		return nil, onet.NewClientError(errors.New("got an empty roster"))
+	}
+	height := -1
+	var err onet.ClientError
+	for _, si := range roster.List {
+		heightResponse := &GetBlocksResponse{}
+		err = c.SendProtobuf(si, &GetBlocksRequest{0, 0}, heightResponse)
+		if err == nil && heightResponse.Height > height {
+			height = heightResponse.Height
+		}
+	}
+	if height < 0 {
+		return nil, err
+	}
+	leader, err2 := protocol.RoundRobinLeader(roster, height+1)
+	if err2 != nil {
+		return nil, onet.NewClientError(err2)
+	}
+	return roster.List[leader], nil
+}
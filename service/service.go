@@ -0,0 +1,550 @@
+package service
+
+/*
+The service exposes the protocol to the clients. It receives signature requests,
+runs the protocol on the given roster, restarting it if it fails or times out,
+and returns the resulting collective signature.
+
+It also maintains a ledger of collectively signed blocks. The servers of the roster
+lead the rounds in turn, the block at height h being signed in round h+1.
+The leader signs the new block and propagates it to the other servers, which store it
+after verifying its signature, its leader and its link to their last block.
+Weighting the rotation by the reputation of the servers is out of scope: the servers
+would have to agree on the reputations, while each one only records the rounds it leads.
+
+The roster can change over time: the roster of the current epoch signs a forward link
+to the roster of the next epoch, which signs the following blocks.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/ledger"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// serviceID is used to find the service from the local tests
+var serviceID onet.ServiceID
+
+func init() {
+	var err error
+	serviceID, err = onet.RegisterNewService(ServiceName, newService)
+	log.ErrFatal(err)
+}
+
+// Service handles the signature requests of the clients.
+type Service struct {
+	*onet.ServiceProcessor
+
+	ProtocolTimeout time.Duration
+	Retries         int
+	// LedgerPolicy is the minimum number of servers of the roster that have to sign
+	// the blocks and forward links accepted by this server, zero meaning every server.
+	// It is set by the configuration of the server, never by the sender of a block.
+	LedgerPolicy int
+
+	ledger     *ledger.Ledger
+	ledgerLock sync.Mutex //serializes the additions of blocks and forward links
+	treeCache  *protocol.TreeCache
+	costModel  *protocol.CostModel       //chooses the number of subtrees of the requests leaving it to zero
+	reputation *protocol.ReputationTable //of the nodes of the rounds led by this server
+}
+
+// newService registers the handlers of the service.
+func newService(c *onet.Context) (onet.Service, error) {
+	s := &Service{
+		ServiceProcessor: onet.NewServiceProcessor(c),
+		ProtocolTimeout:  protocol.DefaultProtocolTimeout,
+		Retries:          DefaultRetries,
+		ledger:           ledger.NewLedger(),
+		treeCache:        protocol.NewTreeCache(),
+		costModel:        protocol.NewCostModel(),
+		reputation:       protocol.NewReputationTable(),
+	}
+	for _, handler := range []interface{}{s.SignatureRequest, s.StoreBlockRequest, s.GetBlocksRequest,
+		s.EpochChangeRequest, s.GetForwardLinksRequest, s.ReputationRequest} {
+		err := s.RegisterHandler(handler)
+		if err != nil {
+			return nil, errors.New("couldn't register handler: " + err.Error())
+		}
+	}
+	s.RegisterProcessorFunc(propagateBlockID, s.handlePropagateBlock)
+	s.RegisterProcessorFunc(propagateForwardLinkID, s.handlePropagateForwardLink)
+	return s, nil
+}
+
+// SignatureRequest runs the protocol on the given roster to sign the message
+// and returns the collective signature.
+func (s *Service) SignatureRequest(req *SignatureRequest) (network.Message, onet.ClientError) {
+
+	//request verification
+	if req.Roster == nil || len(req.Roster.List) < 1 {
+		return nil, onet.NewClientErrorCode(ErrorParse, "empty roster")
+	}
+	if req.Message == nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, "no message to sign")
+	}
+	if req.Policy < 0 || req.Policy > len(req.Roster.List) {
+		return nil, onet.NewClientErrorCode(ErrorParse,
+			fmt.Sprintf("policy should be in range [0, %d], but is %d", len(req.Roster.List), req.Policy))
+	}
+	if !req.Roster.List[0].ID.Equal(s.ServerIdentity().ID) {
+		return nil, onet.NewClientErrorCode(ErrorParse, "this server is not the first server of the roster")
+	}
+
+	signature, err := s.sign(req.Roster, req.Roster, req.Message, req.NSubtrees, req.Policy, 0)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorProtocol, err.Error())
+	}
+
+	lenSig := network.Suite.PointLen() + network.Suite.ScalarLen() //V || r, the mask follows
+	return &SignatureResponse{signature, signature[lenSig:]}, nil
+}
+
+// NewProtocol sets the leader verification on the subprotocol nodes,
+// the other protocols being instantiated by onet.
+func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfig) (onet.ProtocolInstance, error) {
+	if tn.ProtocolName() != protocol.SubProtocolName {
+		return nil, nil
+	}
+	pi, err := protocol.NewSubProtocol(tn)
+	if err != nil {
+		return nil, err
+	}
+	pi.(*protocol.CoSiSubProtocolNode).LeaderVerifier = s.verifyLeader
+	return pi, nil
+}
+
+// verifyLeader checks that a round of the ledger follows its last block and is led by
+// the server expected by the ledger's roster. The signature requests, in round zero,
+// are signed on any roster and not checked against the ledger.
+func (s *Service) verifyLeader(round int, leader *network.ServerIdentity) error {
+	if round == 0 {
+		return nil
+	}
+	if height := s.ledger.Height(); round != height+1 {
+		return fmt.Errorf("round %d should sign the block at height %d, but signs the one at height %d",
+			round, height, round-1)
+	}
+	roster := s.ledger.Roster()
+	if roster == nil { //the genesis block fixes the roster
+		return nil
+	}
+	return protocol.RoundRobinVerifier(roster)(round, leader)
+}
+
+// sign runs the protocol on the signers roster, restarting it on failure,
+// until it produces a signature satisfying the policy.
+// The mask follows the order of the roster, while the first server of the signers,
+// which must be this server, leads the protocol.
+func (s *Service) sign(roster, signers *onet.Roster, message []byte, nSubtrees, threshold, round int) ([]byte, error) {
+
+	var policy cosi.Policy = cosi.CompletePolicy{}
+	if threshold > 0 {
+		policy = cosi.ThresholdPolicy{T: threshold}
+	}
+
+	nChildren := len(signers.List) - 1
+	if nChildren < 1 {
+		nChildren = 1
+	}
+	tree := signers.GenerateNaryTree(nChildren)
+	if tree == nil {
+		return nil, errors.New("couldn't generate tree from roster")
+	}
+
+	publics := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		publics[i] = si.Public
+	}
+
+	var err error
+	for try := 0; try <= s.Retries; try++ {
+		var signature []byte
+		signature, err = s.runProtocol(tree, publics, message, nSubtrees, round, policy)
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "attempt", try, "failed:", err)
+			continue
+		}
+
+		err = cosi.Verify(network.Suite, publics, message, signature, policy)
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "attempt", try, "produced an invalid signature:", err)
+			continue
+		}
+		return signature, nil
+	}
+
+	return nil, fmt.Errorf("no valid signature after %d attempt(s): %s", s.Retries+1, err)
+}
+
+// StoreBlockRequest signs a new block containing the payload, appends it to the
+// ledger and propagates it to the other servers of the roster.
+// This server must be the leader of the round of the block.
+func (s *Service) StoreBlockRequest(req *StoreBlockRequest) (network.Message, onet.ClientError) {
+
+	//request verification
+	if req.Roster == nil || len(req.Roster.List) < 1 {
+		return nil, onet.NewClientErrorCode(ErrorParse, "empty roster")
+	}
+	if req.Payload == nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, "no payload to store")
+	}
+	if req.Policy < 0 || req.Policy > len(req.Roster.List) {
+		return nil, onet.NewClientErrorCode(ErrorParse,
+			fmt.Sprintf("policy should be in range [0, %d], but is %d", len(req.Roster.List), req.Policy))
+	}
+
+	//check leader, the ledger being only locked to read its last block
+	s.ledgerLock.Lock()
+	if roster := s.ledger.Roster(); roster != nil && !roster.ID.Equal(req.Roster.ID) {
+		s.ledgerLock.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorParse, "the ledger is maintained by another roster")
+	}
+	block := ledger.NewBlock(s.ledger.Last(), req.Payload, req.Roster)
+	s.ledgerLock.Unlock()
+	round := block.Height + 1
+	signers, cerr := s.signersOf(req.Roster, round)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	//sign block, without blocking the ledger for the duration of the protocol
+	signature, err := s.sign(req.Roster, signers, block.Hash(), req.NSubtrees, s.ledgerThreshold(req.Policy), round)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorProtocol, err.Error())
+	}
+	block.Signature = signature
+
+	//store and propagate block, unless the ledger grew meanwhile
+	s.ledgerLock.Lock()
+	defer s.ledgerLock.Unlock()
+	if height := s.ledger.Height(); height != block.Height {
+		return nil, onet.NewClientErrorCode(ErrorLedger,
+			fmt.Sprintf("the ledger reached height %d while block %d was signed", height, block.Height))
+	}
+	if s.ledger.Genesis() == nil {
+		err = s.ledger.SetGenesis(req.Roster)
+		if err != nil {
+			return nil, onet.NewClientErrorCode(ErrorLedger, err.Error())
+		}
+	}
+	err = s.ledger.Append(block)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorLedger, err.Error())
+	}
+
+	propagate := &PropagateBlock{req.Roster, block}
+	for _, si := range signers.List[1:] {
+		err = s.SendRaw(si, propagate)
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't propagate block to", si, ":", err)
+		}
+	}
+
+	return &StoreBlockResponse{block}, nil
+}
+
+// GetBlocksRequest returns the blocks of the local ledger in the requested range.
+func (s *Service) GetBlocksRequest(req *GetBlocksRequest) (network.Message, onet.ClientError) {
+	blocks, err := s.ledger.Range(req.Start, req.End)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
+	}
+	return &GetBlocksResponse{blocks, s.ledger.Height()}, nil
+}
+
+// ReputationRequest returns the reputation of the nodes of the rounds led by this server,
+// the ones with a bad reputation not being chosen as subleaders.
+func (s *Service) ReputationRequest(req *ReputationRequest) (network.Message, onet.ClientError) {
+	return &ReputationResponse{s.reputation.Reputations()}, nil
+}
+
+// handlePropagateBlock stores a block sent by the leader after verifying it.
+func (s *Service) handlePropagateBlock(env *network.Envelope) {
+	propagate, ok := env.Msg.(*PropagateBlock)
+	if !ok {
+		log.Error(s.ServerIdentity(), "received an invalid block message")
+		return
+	}
+	if propagate.Roster == nil || len(propagate.Roster.List) < 1 || propagate.Block == nil {
+		log.Error(s.ServerIdentity(), "received an incomplete block message")
+		return
+	}
+	leader, err := protocol.RoundRobinLeader(propagate.Roster, propagate.Block.Height+1)
+	if err != nil || !propagate.Roster.List[leader].ID.Equal(env.ServerIdentity.ID) {
+		log.Error(s.ServerIdentity(), "received a block from a server that doesn't lead its round")
+		return
+	}
+
+	s.ledgerLock.Lock()
+	defer s.ledgerLock.Unlock()
+
+	if roster := s.ledger.Roster(); roster != nil && !roster.ID.Equal(propagate.Roster.ID) {
+		log.Error(s.ServerIdentity(), "received a block signed by another roster than the ledger's one")
+		return
+	}
+	err = propagate.Block.Verify(propagate.Roster, s.ledgerPolicy())
+	if err != nil {
+		log.Error(s.ServerIdentity(), "received an invalid block:", err)
+		return
+	}
+	if s.ledger.Genesis() == nil {
+		err = s.ledger.SetGenesis(propagate.Roster)
+		if err != nil {
+			log.Error(s.ServerIdentity(), "couldn't store received block:", err)
+			return
+		}
+	}
+	err = s.ledger.Append(propagate.Block)
+	if err != nil {
+		log.Error(s.ServerIdentity(), "couldn't store received block:", err)
+		return
+	}
+	log.Lvl3(s.ServerIdentity(), "stored block", propagate.Block.Height)
+}
+
+// EpochChangeRequest makes the roster of the current epoch collectively sign the
+// roster of the next epoch, adopts it, and propagates the forward link to the
+// servers of both rosters. The servers joining receive the history of the chain.
+// This server must be the leader of the next round.
+func (s *Service) EpochChangeRequest(req *EpochChangeRequest) (network.Message, onet.ClientError) {
+
+	//request verification
+	if req.Roster == nil || len(req.Roster.List) < 1 {
+		return nil, onet.NewClientErrorCode(ErrorParse, "empty roster")
+	}
+	if req.NewRoster == nil || len(req.NewRoster.List) < 1 {
+		return nil, onet.NewClientErrorCode(ErrorParse, "empty new roster")
+	}
+	if req.Policy < 0 || req.Policy > len(req.Roster.List) {
+		return nil, onet.NewClientErrorCode(ErrorParse,
+			fmt.Sprintf("policy should be in range [0, %d], but is %d", len(req.Roster.List), req.Policy))
+	}
+
+	//check leader, the ledger being only locked to read its height
+	s.ledgerLock.Lock()
+	if roster := s.ledger.Roster(); roster != nil && !roster.ID.Equal(req.Roster.ID) {
+		s.ledgerLock.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorParse, "the ledger is maintained by another roster")
+	}
+	link := &ledger.ForwardLink{Height: s.ledger.Height(), NewRoster: req.NewRoster}
+	s.ledgerLock.Unlock()
+	round := link.Height + 1
+	signers, cerr := s.signersOf(req.Roster, round)
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	//sign forward link, without blocking the ledger for the duration of the protocol
+	signature, err := s.sign(req.Roster, signers, link.Hash(), req.NSubtrees, s.ledgerThreshold(req.Policy), round)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorProtocol, err.Error())
+	}
+	link.Signature = signature
+
+	//adopt new roster, unless the ledger changed meanwhile
+	s.ledgerLock.Lock()
+	defer s.ledgerLock.Unlock()
+	if roster := s.ledger.Roster(); roster != nil && !roster.ID.Equal(req.Roster.ID) {
+		return nil, onet.NewClientErrorCode(ErrorLedger, "the epoch changed while the forward link was signed")
+	}
+	if height := s.ledger.Height(); height != link.Height {
+		return nil, onet.NewClientErrorCode(ErrorLedger,
+			fmt.Sprintf("the ledger reached height %d while the forward link at %d was signed", height, link.Height))
+	}
+	if s.ledger.Genesis() == nil {
+		err = s.ledger.SetGenesis(req.Roster)
+		if err != nil {
+			return nil, onet.NewClientErrorCode(ErrorLedger, err.Error())
+		}
+	}
+	err = s.ledger.AddForwardLink(link)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorLedger, err.Error())
+	}
+
+	//propagate forward link, with the history to the joining servers
+	blocks, err := s.ledger.Range(0, link.Height)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorLedger, err.Error())
+	}
+	update := &PropagateForwardLink{Roster: req.Roster, Link: link}
+	history := &PropagateForwardLink{Roster: req.Roster, Link: link,
+		Genesis: s.ledger.Genesis(), Links: s.ledger.ForwardLinks(), Blocks: blocks}
+	for _, si := range signers.List[1:] {
+		err = s.SendRaw(si, update)
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't propagate forward link to", si, ":", err)
+		}
+	}
+	for _, si := range req.NewRoster.List {
+		if i, _ := req.Roster.Search(si.ID); i >= 0 {
+			continue
+		}
+		err = s.SendRaw(si, history)
+		if err != nil {
+			log.Lvl2(s.ServerIdentity(), "couldn't propagate history to", si, ":", err)
+		}
+	}
+
+	return &EpochChangeResponse{link}, nil
+}
+
+// GetForwardLinksRequest returns the genesis roster and the forward links of the local ledger.
+func (s *Service) GetForwardLinksRequest(req *GetForwardLinksRequest) (network.Message, onet.ClientError) {
+	return &GetForwardLinksResponse{s.ledger.Genesis(), s.ledger.ForwardLinks()}, nil
+}
+
+// handlePropagateForwardLink adopts the roster of the next epoch after verifying
+// its forward link. Servers joining the roster verify and store the whole history.
+func (s *Service) handlePropagateForwardLink(env *network.Envelope) {
+	propagate, ok := env.Msg.(*PropagateForwardLink)
+	if !ok {
+		log.Error(s.ServerIdentity(), "received an invalid forward link message")
+		return
+	}
+	if propagate.Roster == nil || len(propagate.Roster.List) < 1 || propagate.Link == nil {
+		log.Error(s.ServerIdentity(), "received an incomplete forward link message")
+		return
+	}
+	leader, err := protocol.RoundRobinLeader(propagate.Roster, propagate.Link.Height+1)
+	if err != nil || !propagate.Roster.List[leader].ID.Equal(env.ServerIdentity.ID) {
+		log.Error(s.ServerIdentity(), "received a forward link from a server that doesn't lead its round")
+		return
+	}
+
+	s.ledgerLock.Lock()
+	defer s.ledgerLock.Unlock()
+
+	policy := s.ledgerPolicy()
+	roster := s.ledger.Roster()
+
+	//joining server, verify and store the history
+	if roster == nil {
+		if propagate.Genesis == nil || len(propagate.Links) < 1 {
+			log.Error(s.ServerIdentity(), "received a forward link without the history of the chain")
+			return
+		}
+		last := propagate.Links[len(propagate.Links)-1]
+		if !bytes.Equal(last.Hash(), propagate.Link.Hash()) {
+			log.Error(s.ServerIdentity(), "received a history not ending with the forward link")
+			return
+		}
+		if len(propagate.Blocks) > 0 {
+			err = ledger.VerifyEpochChain(propagate.Blocks, propagate.Genesis, propagate.Links, policy)
+		} else {
+			_, err = ledger.FollowForwardLinks(propagate.Genesis, propagate.Links, policy)
+		}
+		if err != nil {
+			log.Error(s.ServerIdentity(), "received an invalid history:", err)
+			return
+		}
+		err = s.ledger.Bootstrap(propagate.Genesis, propagate.Links, propagate.Blocks)
+		if err != nil {
+			log.Error(s.ServerIdentity(), "couldn't store received history:", err)
+			return
+		}
+		log.Lvl3(s.ServerIdentity(), "joined the roster at height", propagate.Link.Height)
+		return
+	}
+
+	if !roster.ID.Equal(propagate.Roster.ID) {
+		log.Error(s.ServerIdentity(), "received a forward link from another roster than the ledger's one")
+		return
+	}
+	err = propagate.Link.Verify(roster, policy)
+	if err != nil {
+		log.Error(s.ServerIdentity(), "received an invalid forward link:", err)
+		return
+	}
+	err = s.ledger.AddForwardLink(propagate.Link)
+	if err != nil {
+		log.Error(s.ServerIdentity(), "couldn't store received forward link:", err)
+		return
+	}
+	log.Lvl3(s.ServerIdentity(), "adopted new roster at height", propagate.Link.Height)
+}
+
+// ledgerPolicy returns the policy that the blocks and forward links have to satisfy
+// to be accepted by this server.
+func (s *Service) ledgerPolicy() cosi.Policy {
+	if s.LedgerPolicy > 0 {
+		return cosi.ThresholdPolicy{T: s.LedgerPolicy}
+	}
+	return cosi.CompletePolicy{}
+}
+
+// ledgerThreshold returns the stricter of the requested threshold and the ledger policy,
+// zero meaning every server, so that the other servers accept what this server signs.
+func (s *Service) ledgerThreshold(requested int) int {
+	if requested == 0 || s.LedgerPolicy == 0 {
+		return 0
+	}
+	if requested < s.LedgerPolicy {
+		return s.LedgerPolicy
+	}
+	return requested
+}
+
+// signersOf checks that this server leads the round and returns the roster
+// with this server first, to be used as signers.
+func (s *Service) signersOf(roster *onet.Roster, round int) (*onet.Roster, onet.ClientError) {
+	leader, err := protocol.RoundRobinLeader(roster, round)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
+	}
+	if !roster.List[leader].ID.Equal(s.ServerIdentity().ID) {
+		return nil, onet.NewClientErrorCode(ErrorParse,
+			fmt.Sprintf("this server doesn't lead round %d, %s does", round, roster.List[leader].Address))
+	}
+	signers, err := protocol.RosterWithLeader(roster, leader)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
+	}
+	return signers, nil
+}
+
+// runProtocol starts the protocol on the given tree and waits for the signature,
+// the root sending the challenge as soon as the commitments satisfy the policy.
+func (s *Service) runProtocol(tree *onet.Tree, publics []abstract.Point, message []byte, nSubtrees, round int,
+	policy cosi.Policy) ([]byte, error) {
+
+	pi, err := s.CreateProtocol(protocol.ProtocolName, tree)
+	if err != nil {
+		return nil, err
+	}
+	cosiProtocol := pi.(*protocol.CoSiRootNode)
+	cosiProtocol.CreateProtocol = s.CreateProtocol
+	cosiProtocol.Proposal = message
+	cosiProtocol.NSubtrees = nSubtrees
+	cosiProtocol.ProtocolTimeout = s.ProtocolTimeout
+	cosiProtocol.Publics = publics
+	cosiProtocol.Policy = policy
+	cosiProtocol.Round = round
+	cosiProtocol.TreeCache = s.treeCache
+	cosiProtocol.CostModel = s.costModel
+	cosiProtocol.Reputation = s.reputation
+
+	err = cosiProtocol.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case signature := <-cosiProtocol.FinalSignature:
+		return signature, nil
+	case <-time.After(s.ProtocolTimeout):
+		cosiProtocol.Shutdown()
+		return nil, errors.New("protocol timed out")
+	}
+}
@@ -0,0 +1,437 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/fault"
+	"github.com/dedis/student_17_bftcosi/ledger"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// Tests a signature request through the client API
+func TestServiceSignature(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	nodes := []int{1, 5, 13}
+	message := []byte("hello world")
+
+	for _, nNodes := range nodes {
+		_, roster, _ := local.GenTree(nNodes, true)
+
+		publics := make([]abstract.Point, len(roster.List))
+		for i, si := range roster.List {
+			publics[i] = si.Public
+		}
+
+		client := NewClient()
+		response, err := client.SignatureRequest(roster, message, 2, 0)
+		if err != nil {
+			t.Fatal("error in signature request:", err)
+		}
+
+		err2 := cosi.Verify(network.Suite, publics, message, response.Signature, cosi.CompletePolicy{})
+		if err2 != nil {
+			t.Fatal("didn't get a valid signature:", err2)
+		}
+
+		mask, err2 := cosi.NewMask(network.Suite, publics, nil)
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+		err2 = mask.SetMask(response.Mask)
+		if err2 != nil {
+			t.Fatal("the returned mask is invalid:", err2)
+		}
+		if mask.CountEnabled() != nNodes {
+			t.Fatal("the mask should have", nNodes, "enabled bits, but has", mask.CountEnabled())
+		}
+	}
+}
+
+// Tests that invalid requests are rejected
+func TestServiceErrors(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	_, roster, _ := local.GenTree(5, true)
+	client := NewClient()
+
+	if _, err := client.SignatureRequest(roster, nil, 2, 0); err == nil {
+		t.Fatal("the service should refuse a request without message, but doesn't")
+	}
+	if _, err := client.SignatureRequest(roster, []byte{0xFF}, 2, 6); err == nil {
+		t.Fatal("the service should refuse a policy greater than the roster size, but doesn't")
+	}
+
+	//the request must be sent to the first server of the roster
+	reversed := onet.NewRoster([]*network.ServerIdentity{roster.List[1], roster.List[0]})
+	request := &SignatureRequest{Roster: reversed, Message: []byte{0xFF}}
+	if err := client.SendProtobuf(roster.List[0], request, &SignatureResponse{}); err == nil {
+		t.Fatal("the service should refuse a request if it isn't the root, but doesn't")
+	}
+}
+
+// Tests that a signature request with a threshold succeeds without waiting for
+// a node that doesn't respond
+func TestServiceSignatureThreshold(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+	nNodes := 5
+	message := []byte("hello world")
+
+	servers, roster, _ := local.GenTree(nNodes, true)
+	publics := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		publics[i] = si.Public
+	}
+
+	//with one subtree per node, the root gets the other commitments without any
+	//timeout, and fails the request if it waits for the missing one
+	root := local.GetServices(servers, serviceID)[0].(*Service)
+	root.ProtocolTimeout = 5 * time.Second
+	root.Retries = 0
+	failing := roster.List[nNodes-1].ID
+	fault.Install(local.Servers[failing], local.Overlays[failing],
+		fault.Rule{Message: "Announcement", Action: fault.Drop})
+
+	client := NewClient()
+	response, err := client.SignatureRequest(roster, message, nNodes-1, nNodes-1)
+	if err != nil {
+		t.Fatal("error in signature request:", err)
+	}
+
+	err2 := cosi.Verify(network.Suite, publics, message, response.Signature, cosi.ThresholdPolicy{T: nNodes - 1})
+	if err2 != nil {
+		t.Fatal("didn't get a valid signature:", err2)
+	}
+	mask, err2 := cosi.NewMask(network.Suite, publics, nil)
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	err2 = mask.SetMask(response.Mask)
+	if err2 != nil {
+		t.Fatal("the returned mask is invalid:", err2)
+	}
+	if enabled, _ := mask.IndexEnabled(nNodes - 1); enabled || mask.CountEnabled() != nNodes-1 {
+		t.Fatal("every node but the failing one should have signed, but the mask has", mask.CountEnabled(), "enabled bits")
+	}
+}
+
+// Tests that stored blocks are linked, signed and present on every server
+func TestServiceLedger(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	nBlocks := 3
+	_, roster, _ := local.GenTree(5, true)
+	client := NewClient()
+
+	for i := 0; i < nBlocks; i++ {
+		block, err := client.StoreBlock(roster, []byte{byte(i)}, 2, 0)
+		if err != nil {
+			t.Fatal("couldn't store block:", err)
+		}
+		if block.Height != i {
+			t.Fatal("expected block at height", i, "but got", block.Height)
+		}
+	}
+
+	for _, si := range roster.List {
+		var blocks []*ledger.Block
+		for try := 0; try < 10; try++ { //blocks are propagated asynchronously
+			var err onet.ClientError
+			blocks, err = client.GetBlocks(si, 0, nBlocks)
+			if err != nil {
+				t.Fatal("couldn't get blocks:", err)
+			}
+			if len(blocks) == nBlocks {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if len(blocks) != nBlocks {
+			t.Fatal(si, "should store", nBlocks, "blocks, but stores", len(blocks))
+		}
+		err := ledger.VerifyChain(blocks, roster, cosi.CompletePolicy{})
+		if err != nil {
+			t.Fatal("the chain of", si, "doesn't verify:", err)
+		}
+	}
+}
+
+// Tests that a new roster signs the blocks after an epoch change and that
+// a joining server can verify the whole chain from the genesis roster
+func TestServiceEpochChange(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	_, all, _ := local.GenTree(5, true)
+	oldRoster := onet.NewRoster(all.List[:4])
+	newRoster := onet.NewRoster(all.List[1:])
+	joining := all.List[4]
+	client := NewClient()
+
+	if _, err := client.StoreBlock(oldRoster, []byte{0}, 2, 0); err != nil {
+		t.Fatal("couldn't store block:", err)
+	}
+	link, err := client.EpochChange(oldRoster, newRoster, 2, 0)
+	if err != nil {
+		t.Fatal("couldn't change epoch:", err)
+	}
+	if link.Height != 1 {
+		t.Fatal("the new epoch should start at height 1, but starts at", link.Height)
+	}
+	if _, err := client.StoreBlock(oldRoster, []byte{1}, 2, 0); err == nil {
+		t.Fatal("the old roster should not be able to sign blocks anymore, but is")
+	}
+
+	var block *ledger.Block
+	for try := 0; try < 10; try++ { //the history is propagated asynchronously
+		block, err = client.StoreBlock(newRoster, []byte{1}, 2, 0)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("couldn't store block with the new roster:", err)
+	}
+	if !block.RosterID.Equal(newRoster.ID) {
+		t.Fatal("the block should be signed by the new roster, but isn't")
+	}
+
+	//light client verification from the joining server
+	var genesis *onet.Roster
+	var links []*ledger.ForwardLink
+	var blocks []*ledger.Block
+	for try := 0; try < 10; try++ {
+		genesis, links, err = client.GetForwardLinks(joining)
+		if err != nil {
+			t.Fatal("couldn't get forward links:", err)
+		}
+		blocks, err = client.GetBlocks(joining, 0, 2)
+		if err != nil {
+			t.Fatal("couldn't get blocks:", err)
+		}
+		if len(blocks) == 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if genesis == nil || !genesis.ID.Equal(oldRoster.ID) {
+		t.Fatal("the genesis roster should be the old roster, but isn't")
+	}
+	current, err2 := ledger.FollowForwardLinks(genesis, links, cosi.CompletePolicy{})
+	if err2 != nil {
+		t.Fatal("the forward links don't verify:", err2)
+	}
+	if !current.ID.Equal(newRoster.ID) {
+		t.Fatal("the forward links should lead to the new roster, but don't")
+	}
+	err2 = ledger.VerifyEpochChain(blocks, genesis, links, cosi.CompletePolicy{})
+	if err2 != nil {
+		t.Fatal("the chain doesn't verify:", err2)
+	}
+}
+
+// Tests that the leader of a signature exposes the reputation of the signers
+func TestServiceReputation(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	nNodes := 5
+	_, roster, _ := local.GenTree(nNodes, true)
+
+	client := NewClient()
+	_, err := client.SignatureRequest(roster, []byte("hello world"), 2, 0)
+	if err != nil {
+		t.Fatal("error in signature request:", err)
+	}
+
+	reputations, err := client.Reputation(roster.List[0])
+	if err != nil {
+		t.Fatal("error in reputation request:", err)
+	}
+	if len(reputations) != nNodes-1 {
+		t.Fatal("expected the reputation of", nNodes-1, "nodes, but got", len(reputations))
+	}
+	for _, reputation := range reputations {
+		if reputation.Signed != 1 || reputation.Score <= 0 || reputation.Excluded {
+			t.Fatal("expected every node to have signed once, but got", reputation)
+		}
+	}
+
+	//the other servers didn't lead any round
+	reputations, err = client.Reputation(roster.List[1])
+	if err != nil {
+		t.Fatal("error in reputation request:", err)
+	}
+	if len(reputations) != 0 {
+		t.Fatal("expected no reputation on a server that didn't lead, but got", len(reputations))
+	}
+}
+
+// Tests that a propagated block signed by too few servers is refused,
+// whatever the sender claims, and that it is accepted with a lower ledger policy
+func TestServicePropagateBlockPolicy(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	servers, roster, _ := local.GenTree(5, true)
+	services := local.GetServices(servers, serviceID)
+	publics := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		publics[i] = si.Public
+	}
+
+	//block of round 1, signed by its leader alone
+	leader := 1
+	block := ledger.NewBlock(nil, []byte{0}, roster)
+	var err error
+	block.Signature, err = signAlone(publics, servers[leader].ServerIdentity.Public,
+		local.GetPrivate(servers[leader]), block.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := services[2].(*Service)
+	sender := services[leader].(*Service)
+	err = sender.SendRaw(roster.List[2], &PropagateBlock{roster, block})
+	if err != nil {
+		t.Fatal("couldn't propagate block:", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if receiver.ledger.Height() != 0 {
+		t.Fatal("a block signed by one server should be refused, but is stored")
+	}
+
+	receiver.ledgerLock.Lock() //read by the handler with the lock held
+	receiver.LedgerPolicy = 1
+	receiver.ledgerLock.Unlock()
+	err = sender.SendRaw(roster.List[2], &PropagateBlock{roster, block})
+	if err != nil {
+		t.Fatal("couldn't propagate block:", err)
+	}
+	for try := 0; try < 10 && receiver.ledger.Height() == 0; try++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if receiver.ledger.Height() != 1 {
+		t.Fatal("the block satisfies the ledger policy of the receiver, but isn't stored")
+	}
+}
+
+// Tests that a propagated forward link signed by too few servers of the current
+// roster is refused, the receiver keeping its roster
+func TestServicePropagateForwardLinkPolicy(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	servers, all, _ := local.GenTree(5, true)
+	services := local.GetServices(servers, serviceID)
+	roster := onet.NewRoster(all.List[:4])
+	newRoster := onet.NewRoster(all.List[1:])
+	publics := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		publics[i] = si.Public
+	}
+
+	client := NewClient()
+	if _, err := client.StoreBlock(roster, []byte{0}, 2, 0); err != nil {
+		t.Fatal("couldn't store block:", err)
+	}
+	receiver := services[1].(*Service)
+	for try := 0; try < 10 && receiver.ledger.Height() == 0; try++ { //blocks are propagated asynchronously
+		time.Sleep(100 * time.Millisecond)
+	}
+	if receiver.ledger.Height() != 1 {
+		t.Fatal("the receiver should store the first block, but doesn't")
+	}
+
+	//forward link of round 2, signed by its leader alone
+	leader := 2 % len(roster.List)
+	link := &ledger.ForwardLink{Height: 1, NewRoster: newRoster}
+	var err error
+	link.Signature, err = signAlone(publics, servers[leader].ServerIdentity.Public,
+		local.GetPrivate(servers[leader]), link.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := services[leader].(*Service)
+	err = sender.SendRaw(roster.List[1], &PropagateForwardLink{Roster: roster, Link: link})
+	if err != nil {
+		t.Fatal("couldn't propagate forward link:", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if !receiver.ledger.Roster().ID.Equal(roster.ID) {
+		t.Fatal("a forward link signed by one server should be refused, but is adopted")
+	}
+}
+
+// signAlone returns a collective signature of the message by the given key only.
+func signAlone(publics []abstract.Point, public abstract.Point, private abstract.Scalar, message []byte) ([]byte, error) {
+	secret, commitment := cosi.Commit(network.Suite, nil)
+	mask, err := cosi.NewMask(network.Suite, publics, public)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := cosi.Challenge(network.Suite, commitment, mask.AggregatePublic, message)
+	if err != nil {
+		return nil, err
+	}
+	response, err := cosi.Response(network.Suite, private, secret, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return cosi.Sign(network.Suite, commitment, response, mask)
+}
+
+// Tests that the ledger rounds must follow the last block and be led by the expected server,
+// while the signature requests are accepted on any roster
+func TestServiceVerifyLeader(t *testing.T) {
+	local := onet.NewTCPTest()
+	defer local.CloseAll()
+
+	servers, roster, _ := local.GenTree(5, true)
+	services := local.GetServices(servers, serviceID)
+	client := NewClient()
+
+	if _, err := client.StoreBlock(roster, []byte{0}, 2, 0); err != nil {
+		t.Fatal("couldn't store block:", err)
+	}
+	verifier := services[3].(*Service)
+	for try := 0; try < 10 && verifier.ledger.Height() == 0; try++ { //blocks are propagated asynchronously
+		time.Sleep(100 * time.Millisecond)
+	}
+	if verifier.ledger.Height() != 1 {
+		t.Fatal("the block should be stored, but isn't")
+	}
+
+	if err := verifier.verifyLeader(2, roster.List[2]); err != nil {
+		t.Fatal("the leader of the next round should be accepted, but is refused:", err)
+	}
+	if err := verifier.verifyLeader(2, roster.List[3]); err == nil {
+		t.Fatal("another server than the leader of the next round should be refused, but isn't")
+	}
+	if err := verifier.verifyLeader(1, roster.List[1]); err == nil {
+		t.Fatal("the round of the stored block should be refused, but isn't")
+	}
+	if err := verifier.verifyLeader(7, roster.List[2]); err == nil {
+		t.Fatal("a round ahead of the ledger should be refused, but isn't")
+	}
+
+	//signature request on another roster, led by a server that doesn't lead the ledger rounds
+	other := onet.NewRoster(roster.List[2:])
+	if _, err := client.SignatureRequest(other, []byte("hello world"), 1, 0); err != nil {
+		t.Fatal("a signature request on another roster should be signed, but got", err)
+	}
+}
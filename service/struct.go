@@ -0,0 +1,153 @@
+package service
+
+/*
+Struct holds the messages exchanged between the clients and the service.
+*/
+
+import (
+	"github.com/dedis/student_17_bftcosi/ledger"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ServiceName is the name used to register the service and to reach it from the clients.
+const ServiceName = "BFTCoSiService"
+
+// DefaultRetries is the number of times the service restarts a protocol that didn't
+// produce a signature in time before giving up.
+const DefaultRetries = 3
+
+// Error codes returned by the service to the clients
+const (
+	// ErrorParse indicates an invalid request
+	ErrorParse = iota + 4100
+	// ErrorProtocol indicates the protocol couldn't produce a valid signature
+	ErrorProtocol
+	// ErrorLedger indicates the block couldn't be added to the ledger
+	ErrorLedger
+)
+
+// propagateBlockID is the type of the message used to send signed blocks to the roster
+var propagateBlockID network.MessageTypeID
+
+// propagateForwardLinkID is the type of the message used to send forward links to the rosters
+var propagateForwardLinkID network.MessageTypeID
+
+func init() {
+	network.RegisterMessages(&SignatureRequest{}, &SignatureResponse{},
+		&StoreBlockRequest{}, &StoreBlockResponse{},
+		&GetBlocksRequest{}, &GetBlocksResponse{},
+		&EpochChangeRequest{}, &EpochChangeResponse{},
+		&GetForwardLinksRequest{}, &GetForwardLinksResponse{},
+		&ReputationRequest{}, &ReputationResponse{})
+	propagateBlockID = network.RegisterMessage(&PropagateBlock{})
+	propagateForwardLinkID = network.RegisterMessage(&PropagateForwardLink{})
+}
+
+// SignatureRequest asks the service to collectively sign a message.
+// The service contacted must be the first server of the roster,
+// which will be the root of the protocol.
+type SignatureRequest struct {
+	Roster    *onet.Roster
+	Message   []byte
+	NSubtrees int //zero lets the root choose it from the size of the roster
+	// Policy is the minimum number of servers that have to sign the message,
+	// zero meaning that every server of the roster has to sign.
+	Policy int
+}
+
+// SignatureResponse contains the collective signature of the requested message.
+// The signature is encoded as V || r || Z, Z being the participation mask
+// that is also given in Mask for convenience.
+type SignatureResponse struct {
+	Signature []byte
+	Mask      []byte
+}
+
+// StoreBlockRequest asks the service to append a block containing the payload
+// to the ledger. The block is collectively signed by the roster, which must be
+// the same for every block, and the service contacted must lead the round of the block.
+type StoreBlockRequest struct {
+	Roster    *onet.Roster
+	Payload   []byte
+	NSubtrees int
+	// Policy is the minimum number of servers that have to sign the block,
+	// zero meaning that every server of the roster has to sign. The servers only
+	// accept blocks satisfying their LedgerPolicy, which is used if it is stricter.
+	Policy int
+}
+
+// StoreBlockResponse contains the signed block appended to the ledger.
+type StoreBlockResponse struct {
+	Block *ledger.Block
+}
+
+// GetBlocksRequest asks for the blocks with heights in [Start, End[.
+type GetBlocksRequest struct {
+	Start int
+	End   int
+}
+
+// GetBlocksResponse contains the requested blocks, the last ones missing
+// if the ledger is shorter than the requested range, and the height of the ledger.
+type GetBlocksResponse struct {
+	Blocks []*ledger.Block
+	Height int
+}
+
+// PropagateBlock is sent by the leader to the other servers of the roster
+// so that they store a newly signed block.
+// The receivers verify it against their own policy, see Service.LedgerPolicy.
+type PropagateBlock struct {
+	Roster *onet.Roster
+	Block  *ledger.Block
+}
+
+// EpochChangeRequest asks the roster of the current epoch to sign a forward link
+// to the roster of the next epoch. The service contacted must lead the next round.
+type EpochChangeRequest struct {
+	Roster    *onet.Roster
+	NewRoster *onet.Roster
+	NSubtrees int
+	// Policy is the minimum number of servers of the current roster that have
+	// to sign the link, zero meaning that every server has to sign. The servers only
+	// accept links satisfying their LedgerPolicy, which is used if it is stricter.
+	Policy int
+}
+
+// EpochChangeResponse contains the signed forward link.
+type EpochChangeResponse struct {
+	Link *ledger.ForwardLink
+}
+
+// GetForwardLinksRequest asks for the chain of rosters of the ledger.
+type GetForwardLinksRequest struct {
+}
+
+// GetForwardLinksResponse contains the genesis roster and the forward links
+// leading to the roster of the current epoch.
+type GetForwardLinksResponse struct {
+	Genesis *onet.Roster
+	Links   []*ledger.ForwardLink
+}
+
+// ReputationRequest asks a server for the reputation of the nodes of the rounds it led.
+type ReputationRequest struct {
+}
+
+// ReputationResponse contains the reputation of the nodes, from the lowest score to the highest.
+type ReputationResponse struct {
+	Reputations []protocol.Reputation
+}
+
+// PropagateForwardLink is sent by the leader to the servers of the current and next rosters.
+// The servers joining the roster also receive the genesis roster, the forward links and the blocks.
+// The receivers verify them against their own policy, see Service.LedgerPolicy.
+type PropagateForwardLink struct {
+	Roster  *onet.Roster
+	Link    *ledger.ForwardLink
+	Genesis *onet.Roster
+	Links   []*ledger.ForwardLink
+	Blocks  []*ledger.Block
+}
@@ -24,14 +24,18 @@ import (
 	//"strconv"
 
 	"github.com/BurntSushi/toml"
+	"github.com/dedis/student_17_bftcosi/fault"
 	"github.com/dedis/student_17_bftcosi/protocol"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/simul/monitor"
 	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
 	"gopkg.in/dedis/onet.v1/network"
 	"github.com/dedis/student_17_bftcosi/cosi"
+	"bytes"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -42,11 +46,57 @@ func init() {
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	fault.Config
+	fault.Churn
 	NSubtrees int
 	FailingSubleaders int
 	FailingLeafs int
+
+	//leaves failing at other phases, chosen after the failing leaves
+	FailingAfterCommitment int //ignore the challenge
+	FailingAtChallenge int //never send their response
+	InvalidResponses int //send a random response
+	SlowNodes int //receive every message with SlowDelay milliseconds of delay
+	SlowDelay int
+
+	//0 for the three-level trees, 1 for standard CoSi on a star,
+	//2 for standard CoSi on a balanced tree with branching factor Bf
+	Baseline int
+
+	ProposalSize   int  //size of the proposal in bytes, one byte if not set
+	RandomProposal bool //generate a new random proposal for each round
+	NewTrees       bool //generate new subtrees in each round, shipping them again to the nodes
+
+	//derive the timeouts from the latencies of the previous rounds instead of the static ones
+	AdaptiveTimeouts bool
+
+	//let the root choose the number of subtrees from a cost model, NSubtrees being
+	//only the hand-tuned value it is compared with
+	AutoSubtrees bool
+
+	//if set, the root pings the nodes every LivenessInterval milliseconds and leaves
+	//the ones suspected to be dead out of the subtrees, the failing nodes not answering
+	LivenessInterval int
+
+	//keep the reputation of the nodes across rounds, so that the failing ones are not chosen
+	//as subleaders and, with ExcludeBadNodes, are left out of the subtrees until they recover
+	Reputation      bool
+	ExcludeBadNodes bool
+
+	//run each group with a backup subleader too, the leaves committing to both
+	BackupSubleaders bool
+
+	fixedProposal []byte
+	treeCache     *protocol.TreeCache
+	timeouts      *protocol.TimeoutEstimator
+	costModel     *protocol.CostModel
+	liveness      *protocol.LivenessMonitor
+	reputation    *protocol.ReputationTable
 }
 
+// roundTimeout is the time after which the simulation considers a round attempt has failed
+const roundTimeout = 30 * time.Second
+
 // NewSimulationProtocol is used internally to register the simulation (see the init()
 // function above).
 func NewSimulationProtocol(config string) (onet.Simulation, error) {
@@ -84,41 +134,73 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 	if err != nil {
 		return err
 	}
-	if len(subleadersIds) > s.FailingSubleaders {
-		subleadersIds = subleadersIds[:s.FailingSubleaders]
+	role := "leaf"
+	if contains(subleadersIds, config.Server.ServerIdentity.ID) {
+		role = "subleader"
 	}
 
 	//get leafs ids
-	leafsIds, err := protocol.GetLeafsIDs(config.Tree, s.Hosts, s.NSubtrees)
+	allLeafsIds, err := protocol.GetLeafsIDs(config.Tree, s.Hosts, s.NSubtrees)
 	if err != nil {
 		return err
 	}
-	if len(leafsIds) > s.FailingLeafs {
-		leafsIds = leafsIds[:s.FailingLeafs]
+	failing := s.failingNodes(subleadersIds, allLeafsIds)
+
+	//ignore announcements on some nodes
+	rules := make([]fault.Rule, 0)
+	if contains(failing.announcement, config.Server.ServerIdentity.ID) {
+		rules = append(rules, fault.Rule{Message: "Announcement", Action: fault.Drop})
+		if s.LivenessInterval > 0 {
+			rules = append(rules, fault.Rule{Message: "Ping", Action: fault.Drop})
+		}
 	}
 
-	to_intercept := append(leafsIds, subleadersIds...)
+	//faults of the other phases
+	if contains(failing.afterCommitment, config.Server.ServerIdentity.ID) {
+		rules = append(rules, fault.Rule{Message: "Challenge", Action: fault.Drop})
+	}
+	if len(failing.atChallenge) > 0 {
+		rules = append(rules, fault.Rule{Message: "Response", Action: fault.Drop, Senders: failing.atChallenge})
+	}
+	if len(failing.invalidResponse) > 0 {
+		rules = append(rules, fault.Rule{Message: "Response", Action: fault.Corrupt, Senders: failing.invalidResponse})
+	}
+	if contains(failing.slow, config.Server.ServerIdentity.ID) {
+		rules = append(rules, fault.Rule{Action: fault.Delay, Delay: time.Duration(s.SlowDelay) * time.Millisecond})
+	}
 
-	//intercept announcements on some nodes
-	for _, id := range to_intercept {
-		if id == config.Server.ServerIdentity.ID {
-			config.Server.RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {
-				//get message
-				_, msg, err := network.Unmarshal(e.Msg.(*onet.ProtocolMsg).MsgSlice)
-				if err != nil {
-					log.Fatal("error while unmarshaling a message:", err)
-					return
-				}
+	//inject the fault of the toml row
+	if s.Config.Enabled() {
+		faulty := make([]network.ServerIdentityID, 0)
+		for i := len(config.Roster.List) - s.FaultNodes; i < len(config.Roster.List); i++ {
+			if i > 0 { //the root is never faulty
+				faulty = append(faulty, config.Roster.List[i].ID)
+			}
+		}
+		if s.Config.Applies(config.Server, faulty) {
+			rule, err := s.Config.Rule(faulty)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+	}
 
-				switch msg.(type) { //ignore announcements
-				case *protocol.Announcement:
-					break
-				default:
-					config.Overlay.Process(e)
-				}
-			})
-		break //this node has been found
+	injector := fault.Install(config.Server, config.Overlay, rules...)
+	if index != 0 {
+		injector.SetObserver(bandwidthObserver(role, config.Server))
+	}
+
+	//crash and recover between rounds
+	if s.Churn.Enabled() {
+		err := s.Churn.Check()
+		if err != nil {
+			return err
 		}
+		n := len(config.Roster.List)
+		injector.SetCrashed(func(round int) bool {
+			return s.Churn.Crashed(index, n, round-1)
+		})
 	}
 	log.Lvl3("Initializing node-index", index)
 	return s.SimulationBFTree.Node(config)
@@ -129,45 +211,336 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	log.SetDebugVisible(2)
 	size := config.Tree.Size()
 	log.Lvl2("Size is:", size, "rounds:", s.Rounds)
+
+	//get public keys
+	tree := s.signingTree(config)
+	publics := make([]abstract.Point, tree.Size())
+	for i, node := range tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	if !s.NewTrees {
+		s.treeCache = protocol.NewTreeCache()
+	}
+	if s.AdaptiveTimeouts {
+		s.timeouts = protocol.NewTimeoutEstimator()
+	}
+	if s.AutoSubtrees {
+		s.costModel = protocol.NewCostModel()
+	}
+	if s.Reputation {
+		s.reputation = protocol.NewReputationTable()
+		s.reputation.Exclude = s.ExcludeBadNodes
+	}
+	if s.LivenessInterval > 0 {
+		err := s.startLiveness(config)
+		if err != nil {
+			return err
+		}
+		defer s.liveness.Stop()
+	}
+
 	for round := 0; round < s.Rounds; round++ {
 		log.Lvl1("Starting round", round)
-		round := monitor.NewTimeMeasure("round")
+		roundTime := monitor.NewTimeMeasure("round")
+		proposal := s.proposal()
 
-		proposal := []byte{0xFF}
-		p, err := config.Overlay.CreateProtocol(protocol.ProtocolName, config.Tree,
-			onet.NilServiceID)
+		bandwidth := monitor.NewCounterIOMeasure("bandwidth_root", config.Server)
+
+		Signature, stats, err := s.runRound(config, tree, proposal, round)
 		if err != nil {
 			return err
 		}
-		proto := p.(*protocol.CoSiRootNode)
-		proto.NSubtrees = s.NSubtrees
-		proto.Proposal = proposal
-		proto.SubleaderTimeout = protocol.DefaultSubleaderTimeout / 3000
-		proto.LeavesTimeout = protocol.DefaultLeavesTimeout / 15000
-		proto.CreateProtocol = func(name string, t *onet.Tree) (onet.ProtocolInstance, error) {
-			return config.Overlay.CreateProtocol(name, t, onet.NilServiceID)
+		roundTime.Record()
+		bandwidth.Record()
+
+		//the time measures also record the CPU time of the round
+		if stats != nil {
+			monitor.RecordSingleMeasure("commitment", stats.Commitment.Seconds())
+			monitor.RecordSingleMeasure("challenge", stats.Challenge.Seconds())
+			monitor.RecordSingleMeasure("response", stats.Response.Seconds())
+			monitor.RecordSingleMeasure("subleader_restarts", float64(stats.SubleaderRestarts))
+			monitor.RecordSingleMeasure("backup_commitments", float64(stats.BackupCommitments))
+			monitor.RecordSingleMeasure("subleader_timeout", stats.SubleaderTimeout.Seconds())
+			monitor.RecordSingleMeasure("leaves_timeout", stats.LeavesTimeout.Seconds())
+			monitor.RecordSingleMeasure("nsubtrees", float64(stats.NSubtrees))
+			monitor.RecordSingleMeasure("nsubtrees_tuned", float64(s.NSubtrees))
+		}
+		if s.reputation != nil {
+			excluded := 0
+			for _, reputation := range s.reputation.Reputations() {
+				if reputation.Excluded {
+					excluded++
+				}
+			}
+			monitor.RecordSingleMeasure("excluded", float64(excluded))
 		}
-		proto.ProtocolTimeout = 10* time.Second
-		go func() {
-			log.ErrFatal(p.Start())
-		}()
-		Signature := <-proto.FinalSignature
-		round.Record()
 
-		//get public keys
-		publics := make([]abstract.Point, config.Tree.Size())
-		for i, node := range config.Tree.List() {
-			publics[i] = node.ServerIdentity.Public
+		//with churn, any round may fail, report its outcome
+		if s.Churn.Enabled() {
+			s.recordChurnRound(publics, proposal, Signature, round)
+			continue
 		}
 
-		//verify signature
-		threshold := s.Hosts - s.FailingLeafs - s.FailingSubleaders
-		err = cosi.Verify(network.Suite, publics, proposal, Signature, cosi.ThresholdPolicy{threshold})
+		//verify signature against the expected outcome
+		err = s.checkSignature(publics, proposal, Signature)
 		if err != nil {
-			return fmt.Errorf("error while verifying signature:%s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// startLiveness starts pinging the nodes of the tree from the root, and waits long
+// enough for the failing nodes to be suspected before the first round.
+func (s *SimulationProtocol) startLiveness(config *onet.SimulationConfig) error {
+	interval := time.Duration(s.LivenessInterval) * time.Millisecond
+	var err error
+	s.liveness, err = protocol.NewLivenessMonitor(config.Tree.Roster,
+		func(name string, t *onet.Tree) (onet.ProtocolInstance, error) {
+			return config.Overlay.CreateProtocol(name, t, onet.NilServiceID)
+		}, interval)
+	if err != nil {
+		return err
+	}
+	s.liveness.Start()
+	time.Sleep(3 * interval)
+	return nil
+}
+
+// proposal returns the proposal to sign in a round. It is filled with 0xFF
+// unless RandomProposal is set, in which case new random content is generated
+// for each round.
+func (s *SimulationProtocol) proposal() []byte {
+	size := s.ProposalSize
+	if size < 1 {
+		size = 1
+	}
+	if s.RandomProposal {
+		return random.Bytes(size, random.Stream)
+	}
+	if len(s.fixedProposal) != size {
+		s.fixedProposal = bytes.Repeat([]byte{0xFF}, size)
+	}
+	return s.fixedProposal
+}
+
+// signingTree returns the tree on which the protocol runs, depending on the baseline.
+func (s *SimulationProtocol) signingTree(config *onet.SimulationConfig) *onet.Tree {
+	if s.Baseline == 1 {
+		return config.Roster.GenerateNaryTree(len(config.Roster.List) - 1)
+	}
+	return config.Tree
+}
+
+// runRound runs one attempt of the protocol and returns the signature and the
+// measurements of the root, or a nil signature if the protocol didn't finish in time.
+// The measurements are nil for the baselines.
+func (s *SimulationProtocol) runRound(config *onet.SimulationConfig, tree *onet.Tree, proposal []byte, round int) ([]byte, *protocol.RoundStats, error) {
+	if s.Baseline != 0 {
+		return s.runBaselineRound(config, tree, proposal)
+	}
+
+	p, err := config.Overlay.CreateProtocol(protocol.ProtocolName, tree,
+		onet.NilServiceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	proto := p.(*protocol.CoSiRootNode)
+	proto.NSubtrees = s.NSubtrees
+	if s.AutoSubtrees {
+		proto.NSubtrees = 0
+		proto.CostModel = s.costModel
+	}
+	proto.Proposal = proposal
+	proto.Round = round + 1 //tells the nodes which ones are crashed
+	proto.SubleaderTimeout = protocol.DefaultSubleaderTimeout / 3000
+	proto.LeavesTimeout = protocol.DefaultLeavesTimeout / 15000
+	proto.CreateProtocol = func(name string, t *onet.Tree) (onet.ProtocolInstance, error) {
+		return config.Overlay.CreateProtocol(name, t, onet.NilServiceID)
+	}
+	proto.ProtocolTimeout = 10* time.Second
+	proto.TreeCache = s.treeCache
+	proto.Timeouts = s.timeouts
+	if s.liveness != nil {
+		proto.FailureDetector = s.liveness.Detector
+	}
+	proto.Reputation = s.reputation
+	proto.BackupSubleaders = s.BackupSubleaders
+	go func() {
+		log.ErrFatal(p.Start())
+	}()
+
+	select {
+	case signature := <-proto.FinalSignature:
+		return signature, &proto.Stats, nil
+	case <-time.After(roundTimeout):
+		log.Lvl2("round didn't finish in time")
+		return nil, nil, nil
+	}
+}
+
+// runBaselineRound runs one attempt of the standard CoSi protocol on the given tree.
+func (s *SimulationProtocol) runBaselineRound(config *onet.SimulationConfig, tree *onet.Tree, proposal []byte) ([]byte, *protocol.RoundStats, error) {
+	p, err := config.Overlay.CreateProtocol(protocol.TreeProtocolName, tree,
+		onet.NilServiceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	proto := p.(*protocol.CoSiTreeNode)
+	proto.Proposal = proposal
+	proto.LeavesTimeout = protocol.DefaultLeavesTimeout / 15000
+	go func() {
+		log.ErrFatal(p.Start())
+	}()
+
+	select {
+	case signature := <-proto.FinalSignature:
+		return signature, nil, nil
+	case <-time.After(roundTimeout):
+		log.Lvl2("round didn't finish in time")
+		return nil, nil, nil
+	}
+}
+
+// checkSignature verifies that the signature, nil if the round failed, is the
+// expected outcome of the failures defined in the toml row.
+func (s *SimulationProtocol) checkSignature(publics []abstract.Point, proposal, signature []byte) error {
+
+	//any outcome is possible with a generic fault
+	if s.Config.Enabled() {
+		if signature == nil {
+			log.Lvl2("Round failed")
+			return nil
 		}
-		log.Lvl2("Signature correctly verified!")
+		err := cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: 1})
+		log.Lvl2("Signature verification:", err)
+		return nil
+	}
 
+	//nodes that committed but don't respond make the round fail, and so do invalid
+	//responses, the subleaders detecting them and the root aborting
+	if s.FailingAfterCommitment > 0 || s.FailingAtChallenge > 0 || s.InvalidResponses > 0 {
+		if signature != nil {
+			return fmt.Errorf("expected the round to fail with nodes not responding to the challenge " +
+				"or sending invalid responses, but got a signature")
+		}
+		log.Lvl2("Round failed as expected")
+		return nil
+	}
+	if signature == nil {
+		return fmt.Errorf("round didn't finish in time")
+	}
+
+	//slow nodes may be too slow to be part of the signature
+	threshold := s.Hosts - s.FailingLeafs - s.FailingSubleaders - s.SlowNodes
+	err := cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: threshold})
+	if err != nil {
+		return fmt.Errorf("error while verifying signature:%s", err)
 	}
+	log.Lvl2("Signature correctly verified!")
 	return nil
 }
+
+// recordChurnRound records whether a round with churn succeeded, that is if every
+// node not crashed nor failing is in a valid signature, and how many nodes signed.
+func (s *SimulationProtocol) recordChurnRound(publics []abstract.Point, proposal, signature []byte, round int) {
+	crashed := 0
+	for i := range publics {
+		if s.Churn.Crashed(i, len(publics), round) {
+			crashed++
+		}
+	}
+	monitor.RecordSingleMeasure("crashed", float64(crashed))
+
+	if signature == nil {
+		log.Lvl2("Round", round, "failed with", crashed, "crashed nodes")
+		monitor.RecordSingleMeasure("success", 0)
+		return
+	}
+
+	//the signature is the aggregate commitment and response, followed by the mask
+	lenSig := network.Suite.PointLen() + network.Suite.ScalarLen()
+	mask, err := cosi.NewMask(network.Suite, publics, nil)
+	if err == nil && len(signature) == lenSig+mask.Len() {
+		err = mask.SetMask(signature[lenSig:])
+		if err == nil {
+			monitor.RecordSingleMeasure("signers", float64(mask.CountEnabled()))
+		}
+	}
+
+	threshold := s.Hosts - crashed - s.FailingLeafs - s.FailingSubleaders - s.SlowNodes
+	err = cosi.Verify(network.Suite, publics, proposal, signature, cosi.ThresholdPolicy{T: threshold})
+	if err != nil {
+		log.Lvl2("Round", round, "with", crashed, "crashed nodes gave an insufficient signature:", err)
+		monitor.RecordSingleMeasure("success", 0)
+		return
+	}
+	log.Lvl2("Round", round, "succeeded with", crashed, "crashed nodes")
+	monitor.RecordSingleMeasure("success", 1)
+}
+
+// bandwidthObserver returns an observer recording the bandwidth used by the node
+// between two received challenges, which covers exactly one round.
+func bandwidthObserver(role string, server *onet.Server) func(*network.Envelope, network.Message) {
+	var lock sync.Mutex
+	var measure *monitor.CounterIOMeasure
+	return func(e *network.Envelope, msg network.Message) {
+		if _, ok := msg.(*protocol.Challenge); !ok {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if measure != nil {
+			measure.Record()
+		}
+		measure = monitor.NewCounterIOMeasure("bandwidth_"+role, server)
+	}
+}
+
+// failingIds holds the ids of the nodes failing at each phase.
+type failingIds struct {
+	announcement    []network.ServerIdentityID //failing subleaders and leaves
+	afterCommitment []network.ServerIdentityID
+	atChallenge     []network.ServerIdentityID
+	invalidResponse []network.ServerIdentityID
+	slow            []network.ServerIdentityID
+}
+
+// failingNodes chooses the failing nodes of the toml row: the first subleaders, and
+// disjoint sets of leaves for each phase, in the order of the fields of failingIds.
+func (s *SimulationProtocol) failingNodes(subleadersIds, leafsIds []network.ServerIdentityID) failingIds {
+	var failing failingIds
+	failingSubleaders, _ := split(subleadersIds, s.FailingSubleaders)
+	failingLeafs, leafsIds := split(leafsIds, s.FailingLeafs)
+	failing.afterCommitment, leafsIds = split(leafsIds, s.FailingAfterCommitment)
+	failing.atChallenge, leafsIds = split(leafsIds, s.FailingAtChallenge)
+	failing.invalidResponse, leafsIds = split(leafsIds, s.InvalidResponses)
+	failing.slow, _ = split(leafsIds, s.SlowNodes)
+	failing.announcement = append(failingLeafs, failingSubleaders...)
+	return failing
+}
+
+// split returns copies of the n first ids and of the remaining ones, so that
+// appending to one never overwrites the other.
+func split(ids []network.ServerIdentityID, n int) ([]network.ServerIdentityID, []network.ServerIdentityID) {
+	if n > len(ids) {
+		n = len(ids)
+	}
+	if n < 0 {
+		n = 0
+	}
+	first := append([]network.ServerIdentityID{}, ids[:n]...)
+	rest := append([]network.ServerIdentityID{}, ids[n:]...)
+	return first, rest
+}
+
+// contains returns true if the id is in the list.
+func contains(ids []network.ServerIdentityID, id network.ServerIdentityID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
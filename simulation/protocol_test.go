@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests that each failure category gets exactly its own ids, even when some are
+// appended to others
+func TestFailingNodes(t *testing.T) {
+	subleaders := ids(0, 4)
+	leafs := ids(4, 34)
+	s := &SimulationProtocol{
+		FailingSubleaders:      2,
+		FailingLeafs:           3,
+		FailingAfterCommitment: 4,
+		FailingAtChallenge:     5,
+		InvalidResponses:       6,
+		SlowNodes:              7,
+	}
+
+	failing := s.failingNodes(subleaders, leafs)
+
+	expected := map[string][2][]network.ServerIdentityID{
+		"announcement":    {failing.announcement, append(ids(4, 7), ids(0, 2)...)},
+		"afterCommitment": {failing.afterCommitment, ids(7, 11)},
+		"atChallenge":     {failing.atChallenge, ids(11, 16)},
+		"invalidResponse": {failing.invalidResponse, ids(16, 22)},
+		"slow":            {failing.slow, ids(22, 29)},
+	}
+	for category, got := range expected {
+		if !reflect.DeepEqual(got[0], got[1]) {
+			t.Fatal("wrong ids for", category, "- expected", got[1], "got", got[0])
+		}
+	}
+	if !reflect.DeepEqual(subleaders, ids(0, 4)) || !reflect.DeepEqual(leafs, ids(4, 34)) {
+		t.Fatal("the ids given to failingNodes have been modified")
+	}
+}
+
+// Tests that the categories are truncated when there are fewer leaves than failing nodes
+func TestFailingNodesTruncated(t *testing.T) {
+	s := &SimulationProtocol{FailingSubleaders: 5, FailingLeafs: 2, FailingAfterCommitment: 5, SlowNodes: 1}
+
+	failing := s.failingNodes(ids(0, 2), ids(2, 5))
+
+	if !reflect.DeepEqual(failing.announcement, append(ids(2, 4), ids(0, 2)...)) {
+		t.Fatal("wrong announcement ids:", failing.announcement)
+	}
+	if !reflect.DeepEqual(failing.afterCommitment, ids(4, 5)) {
+		t.Fatal("wrong afterCommitment ids:", failing.afterCommitment)
+	}
+	if len(failing.atChallenge) != 0 || len(failing.invalidResponse) != 0 || len(failing.slow) != 0 {
+		t.Fatal("no leaf should be left for the other categories")
+	}
+}
+
+// ids returns distinct server identity ids numbered from start to end, excluded.
+func ids(start, end int) []network.ServerIdentityID {
+	list := make([]network.ServerIdentityID, 0, end-start)
+	for i := start; i < end; i++ {
+		list = append(list, network.ServerIdentityID{byte(i), 1})
+	}
+	return list
+}
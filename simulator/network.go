@@ -0,0 +1,103 @@
+package simulator
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Link describes the network from one node to another.
+type Link struct {
+	Latency   time.Duration //one-way delay of a message
+	Bandwidth int           //bytes per second of the uplink of the sender, unlimited if zero
+	Loss      float64       //probability that a message is lost, between 0 and 1
+}
+
+// event is a function executed at a given virtual time.
+// Events at the same time are executed in the order they have been scheduled.
+type event struct {
+	at  time.Duration
+	seq uint64
+	fn  func()
+}
+
+// eventQueue implements heap.Interface, ordering events by time then by sequence number.
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// schedule executes fn at the given virtual time.
+func (s *Simulator) schedule(at time.Duration, fn func()) {
+	if at < s.now {
+		at = s.now
+	}
+	s.seq++
+	heap.Push(&s.queue, &event{at, s.seq, fn})
+}
+
+// link returns the link from one node to another.
+func (s *Simulator) link(from, to int) Link {
+	if s.config.Links != nil {
+		return s.config.Links(from, to)
+	}
+	return s.config.Link
+}
+
+// send transmits a message of the given size, calling deliver on the receiver
+// when it arrives. Messages leave the uplink of the sender one after the other,
+// so a node sending to many others pays for each copy.
+func (s *Simulator) send(from, to, size int, deliver func()) {
+	link := s.link(from, to)
+	s.result.Messages++
+	s.result.Bytes += size
+
+	start := s.now
+	if s.uplinks[from] > start {
+		start = s.uplinks[from]
+	}
+	var transmission time.Duration
+	if link.Bandwidth > 0 {
+		transmission = time.Duration(int64(size) * int64(time.Second) / int64(link.Bandwidth))
+	}
+	s.uplinks[from] = start + transmission
+
+	if link.Loss > 0 && s.rand.Float64() < link.Loss {
+		s.result.Lost++
+		return
+	}
+	s.schedule(start+transmission+link.Latency, func() {
+		s.receive(to, deliver)
+	})
+}
+
+// receive handles a message arrived at a node, after the node is done
+// handling the previous ones. Failing nodes ignore every message.
+func (s *Simulator) receive(node int, deliver func()) {
+	if s.failing[node] {
+		return
+	}
+	at := s.now
+	if s.cpus[node] > at {
+		at = s.cpus[node]
+	}
+	at += s.config.Processing
+	s.cpus[node] = at
+	s.schedule(at, deliver)
+}
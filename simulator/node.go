@@ -0,0 +1,440 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// sizes of the messages, in bytes
+const (
+	headerSize    = 64 //approximation of the overhead of onet for each message
+	pointSize     = 32
+	scalarSize    = 32
+	hashSize      = 32
+	nonceSize     = protocol.NonceSize
+	signatureSize = pointSize + scalarSize + 1 //signature of the leader
+	requestSize   = headerSize + hashSize      //request of the public keys to the parent
+	challengeSize = headerSize + scalarSize + signatureSize
+	responseSize  = headerSize + scalarSize
+	stopSize      = headerSize
+)
+
+// root holds the state of the root node, as in CoSiRootNode.
+type root struct {
+	subtrees     []*subtree
+	secret       abstract.Scalar
+	commitment   abstract.Point
+	mask         *cosi.Mask
+	challenge    abstract.Scalar
+	challenged   bool
+	challengedAt time.Duration
+}
+
+// subtree holds the state of the root for one of its subprotocols.
+type subtree struct {
+	tree       *onet.Tree
+	instance   int  //changes each time the subprotocol is restarted
+	done       bool //the commitment is received, or the subtree is ignored
+	running    bool //the commitment is received
+	responded  bool
+	commitment abstract.Point
+	mask       []byte
+	response   abstract.Scalar
+}
+
+// participantKey identifies a node in an instance of a subprotocol.
+type participantKey struct {
+	instance int
+	node     int
+}
+
+// participant holds the state of a subleader or a leaf in an instance
+// of a subprotocol, as in CoSiSubProtocolNode.
+type participant struct {
+	subtree      int
+	instance     int
+	node         int
+	treeNode     *onet.TreeNode
+	commitments  []abstract.Point
+	masks        [][]byte
+	committed    []*onet.TreeNode //children whose commitment has been received in time
+	hasCommitted bool
+	secret       abstract.Scalar
+	challenge    abstract.Scalar
+	responses    []abstract.Scalar
+}
+
+// start generates the trees and starts every subprotocol.
+func (s *Simulator) start() error {
+	trees, err := protocol.GenTrees(s.roster, s.config.Hosts, s.config.NSubtrees)
+	if err != nil {
+		return fmt.Errorf("error in tree generation: %s", err)
+	}
+
+	//if one node, sign without subprotocols
+	if s.config.Hosts == 1 {
+		trees = make([]*onet.Tree, 0)
+	}
+
+	s.root = &root{subtrees: make([]*subtree, len(trees))}
+	for i, tree := range trees {
+		s.root.subtrees[i] = &subtree{}
+		s.startSubtree(i, tree)
+	}
+
+	s.schedule(s.config.ProtocolTimeout, func() {
+		if !s.root.challenged {
+			s.err = errors.New("didn't get commitment in time")
+		}
+	})
+	s.checkCommitments()
+	return nil
+}
+
+// startSubtree starts a new instance of the subprotocol on the given tree.
+func (s *Simulator) startSubtree(i int, tree *onet.Tree) {
+	s.instances++
+	instance := s.instances
+	st := s.root.subtrees[i]
+	st.tree = tree
+	st.instance = instance
+
+	subleader := tree.Root.Children[0]
+	s.send(0, s.index[subleader.ServerIdentity.ID], s.announcementSize(), func() {
+		s.onAnnouncement(i, instance, subleader)
+	})
+	s.schedule(s.now+s.config.SubleaderTimeout, func() {
+		s.onSubleaderTimeout(i, instance)
+	})
+}
+
+// onSubleaderTimeout restarts the subprotocol with the next subleader
+// if the subleader didn't send its commitment in time.
+func (s *Simulator) onSubleaderTimeout(i, instance int) {
+	st := s.root.subtrees[i]
+	if st.instance != instance || st.done {
+		return
+	}
+	s.result.Stats.SubleaderRestarts++
+
+	//send stop signal
+	subleader := st.tree.Root.Children[0]
+	s.send(0, s.index[subleader.ServerIdentity.ID], stopSize, func() {})
+
+	//generate new tree
+	newSubleaderID := subleader.RosterIndex + 1
+	if newSubleaderID >= len(st.tree.Roster.List) {
+		st.done = true
+		s.checkCommitments()
+		return
+	}
+	tree, err := protocol.GenSubtree(st.tree.Roster, newSubleaderID)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.startSubtree(i, tree)
+}
+
+// onAnnouncement resolves the public keys of the announcement, fetching them
+// from the parent if the node doesn't hold them, then handles the announcement.
+func (s *Simulator) onAnnouncement(i, instance int, tn *onet.TreeNode) {
+	node := s.index[tn.ServerIdentity.ID]
+	if !s.config.ColdCache || node == 0 || s.cached[node] {
+		s.forwardAnnouncement(i, instance, tn)
+		return
+	}
+	parent := s.index[tn.Parent.ServerIdentity.ID]
+	s.send(node, parent, requestSize, func() {
+		s.send(parent, node, s.publicsSize(), func() {
+			s.cached[node] = true
+			s.forwardAnnouncement(i, instance, tn)
+		})
+	})
+}
+
+// forwardAnnouncement forwards the announcement to the children of a node,
+// and waits for their commitments.
+func (s *Simulator) forwardAnnouncement(i, instance int, tn *onet.TreeNode) {
+	node := s.index[tn.ServerIdentity.ID]
+	p := &participant{subtree: i, instance: instance, node: node, treeNode: tn}
+	s.participants[participantKey{instance, node}] = p
+	s.result.Disseminated = s.now
+
+	for _, child := range tn.Children {
+		child := child
+		s.send(node, s.index[child.ServerIdentity.ID], s.announcementSize(), func() {
+			s.onAnnouncement(i, instance, child)
+		})
+	}
+
+	if len(tn.Children) == 0 {
+		s.sendCommitment(p)
+		return
+	}
+	s.schedule(s.now+s.config.LeavesTimeout, func() {
+		s.sendCommitment(p)
+	})
+}
+
+// onCommitment is called when a subleader receives the commitment of a leaf.
+func (s *Simulator) onCommitment(instance int, tn, child *onet.TreeNode, commitment abstract.Point, mask []byte) {
+	p := s.participants[participantKey{instance, s.index[tn.ServerIdentity.ID]}]
+	if p == nil || p.hasCommitted {
+		return //too late
+	}
+	p.commitments = append(p.commitments, commitment)
+	p.masks = append(p.masks, mask)
+	p.committed = append(p.committed, child)
+	if len(p.committed) == len(tn.Children) {
+		s.sendCommitment(p)
+	}
+}
+
+// sendCommitment aggregates the commitments received with the one of
+// the node and sends them to its parent.
+func (s *Simulator) sendCommitment(p *participant) {
+	if p.hasCommitted {
+		return
+	}
+	p.hasCommitted = true
+
+	secret, commitment, mask, err := s.commit(p.node, p.commitments, p.masks)
+	if err != nil {
+		s.err = err
+		return
+	}
+	p.secret = secret
+
+	parent := p.treeNode.Parent
+	if parent.Parent == nil {
+		s.send(p.node, 0, s.commitmentSize(), func() {
+			s.onSubCommitment(p.subtree, p.instance, commitment, mask)
+		})
+		return
+	}
+	s.send(p.node, s.index[parent.ServerIdentity.ID], s.commitmentSize(), func() {
+		s.onCommitment(p.instance, parent, p.treeNode, commitment, mask)
+	})
+}
+
+// onSubCommitment is called when the root receives the commitment of a subtree.
+func (s *Simulator) onSubCommitment(i, instance int, commitment abstract.Point, mask []byte) {
+	st := s.root.subtrees[i]
+	if st.instance != instance || st.done {
+		return
+	}
+	st.done = true
+	st.running = true
+	st.commitment = commitment
+	st.mask = mask
+	s.checkCommitments()
+}
+
+// checkCommitments generates and sends the challenge once every subtree has
+// either committed or been ignored.
+func (s *Simulator) checkCommitments() {
+	r := s.root
+	if r.challenged {
+		return
+	}
+	commitments := make([]abstract.Point, 0)
+	masks := make([][]byte, 0)
+	for _, st := range r.subtrees {
+		if !st.done {
+			return
+		}
+		if st.running {
+			commitments = append(commitments, st.commitment)
+			masks = append(masks, st.mask)
+		}
+	}
+	r.challenged = true
+	s.result.Stats.Commitment = s.now
+
+	//generate challenge
+	secret, commitment, aggMask, err := s.commit(0, commitments, masks)
+	if err != nil {
+		s.err = err
+		return
+	}
+	mask, err := cosi.NewMask(s.suite, s.publics, nil)
+	if err != nil {
+		s.err = err
+		return
+	}
+	err = mask.SetMask(aggMask)
+	if err != nil {
+		s.err = err
+		return
+	}
+	challenge, err := cosi.Challenge(s.suite, commitment, mask.AggregatePublic, s.config.Proposal)
+	if err != nil {
+		s.err = err
+		return
+	}
+	r.secret = secret
+	r.commitment = commitment
+	r.mask = mask
+	r.challenge = challenge
+
+	//send challenge to every subtree
+	for _, st := range r.subtrees {
+		if !st.running {
+			continue
+		}
+		subleader := st.tree.Root.Children[0]
+		instance := st.instance
+		s.send(0, s.index[subleader.ServerIdentity.ID], challengeSize, func() {
+			s.onChallenge(instance, subleader, challenge)
+		})
+	}
+	r.challengedAt = s.now
+	if s.uplinks[0] > s.now {
+		s.result.Stats.Challenge = s.uplinks[0] - s.now
+	}
+
+	s.schedule(s.now+s.config.ProtocolTimeout, func() {
+		if s.result.Signature == nil {
+			s.err = errors.New("didn't finish in time")
+		}
+	})
+	s.checkResponses()
+}
+
+// onChallenge forwards the challenge to the children that committed.
+func (s *Simulator) onChallenge(instance int, tn *onet.TreeNode, challenge abstract.Scalar) {
+	p := s.participants[participantKey{instance, s.index[tn.ServerIdentity.ID]}]
+	if p == nil {
+		return
+	}
+	p.challenge = challenge
+	for _, child := range p.committed {
+		child := child
+		s.send(p.node, s.index[child.ServerIdentity.ID], challengeSize, func() {
+			s.onChallenge(instance, child, challenge)
+		})
+	}
+	if len(p.committed) == 0 {
+		s.sendResponse(p)
+	}
+}
+
+// onResponse is called when a subleader receives the response of a leaf.
+func (s *Simulator) onResponse(instance int, tn *onet.TreeNode, response abstract.Scalar) {
+	p := s.participants[participantKey{instance, s.index[tn.ServerIdentity.ID]}]
+	if p == nil {
+		return
+	}
+	p.responses = append(p.responses, response)
+	if len(p.responses) == len(p.committed) {
+		s.sendResponse(p)
+	}
+}
+
+// sendResponse aggregates the responses received with the one of
+// the node and sends them to its parent.
+func (s *Simulator) sendResponse(p *participant) {
+	response, err := s.respond(p.node, p.responses, p.secret, p.challenge)
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	parent := p.treeNode.Parent
+	if parent.Parent == nil {
+		s.send(p.node, 0, responseSize, func() {
+			s.onSubResponse(p.subtree, p.instance, response)
+		})
+		return
+	}
+	s.send(p.node, s.index[parent.ServerIdentity.ID], responseSize, func() {
+		s.onResponse(p.instance, parent, response)
+	})
+}
+
+// onSubResponse is called when the root receives the response of a subtree.
+func (s *Simulator) onSubResponse(i, instance int, response abstract.Scalar) {
+	st := s.root.subtrees[i]
+	if st.instance != instance || !st.running || st.responded {
+		return
+	}
+	st.responded = true
+	st.response = response
+	s.checkResponses()
+}
+
+// checkResponses signs the proposal once every running subtree has responded.
+func (s *Simulator) checkResponses() {
+	r := s.root
+	if s.result.Signature != nil {
+		return
+	}
+	responses := make([]abstract.Scalar, 0)
+	for _, st := range r.subtrees {
+		if !st.running {
+			continue
+		}
+		if !st.responded {
+			return
+		}
+		responses = append(responses, st.response)
+	}
+
+	response, err := s.respond(0, responses, r.secret, r.challenge)
+	if err != nil {
+		s.err = err
+		return
+	}
+	signature, err := cosi.Sign(s.suite, r.commitment, response, r.mask)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.result.Stats.Response = s.now - r.challengedAt - s.result.Stats.Challenge
+	s.result.Signature = signature
+}
+
+// commit generates a personal secret and commitment for a node and returns
+// respectively the secret, the aggregated commitment and the aggregated mask.
+func (s *Simulator) commit(node int, commitments []abstract.Point, masks [][]byte) (abstract.Scalar, abstract.Point, []byte, error) {
+	secret, commitment := cosi.Commit(s.suite, s.stream)
+	personalMask := make([]byte, (s.config.Hosts+7)>>3)
+	personalMask[node>>3] |= 1 << uint(node&7)
+
+	aggCommitment, aggMask, err := cosi.AggregateCommitments(s.suite,
+		append(commitments, commitment), append(masks, personalMask))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return secret, aggCommitment, aggMask, nil
+}
+
+// respond generates a personal response for a node and returns
+// the aggregated response of its children and itself.
+func (s *Simulator) respond(node int, responses []abstract.Scalar, secret, challenge abstract.Scalar) (abstract.Scalar, error) {
+	personalResponse, err := cosi.Response(s.suite, s.privates[node], secret, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return cosi.AggregateResponses(s.suite, append(responses, personalResponse))
+}
+
+func (s *Simulator) announcementSize() int {
+	//proposal, hash of the public keys, the three other fields of the announcement, the nonce and the signature of the leader
+	return headerSize + len(s.config.Proposal) + hashSize + 3*8 + nonceSize + signatureSize
+}
+
+func (s *Simulator) publicsSize() int {
+	return headerSize + pointSize*s.config.Hosts
+}
+
+func (s *Simulator) commitmentSize() int {
+	return headerSize + pointSize + (s.config.Hosts+7)>>3
+}
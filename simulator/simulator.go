@@ -0,0 +1,190 @@
+// Package simulator is a model of the BFTCoSi protocol, run in memory over a virtual clock.
+//
+// It reimplements the behaviour of CoSiRootNode and CoSiSubProtocolNode instead of
+// running their handlers: the same three-level trees, the same timeouts and the same
+// restarts of failing subleaders, with real CoSi signatures. It leaves out the policies,
+// the backup subleaders, the reputations and the detection of the nodes breaking the
+// protocol, and only counts the signatures of the leader in the size of the messages,
+// so its results estimate the costs of the design, not the behaviour of the protocol.
+//
+// Messages go through links with a configurable latency, bandwidth and loss, and every
+// random choice comes from the seed, so a run can be reproduced exactly. Since no time
+// is spent waiting, thousands of nodes can be simulated on a single machine.
+package simulator
+
+import (
+	"container/heap"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/protocol"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Config holds the parameters of a simulated run.
+type Config struct {
+	Hosts     int
+	NSubtrees int
+	Proposal  []byte
+	Seed      int64
+
+	Link       Link                    //link between every pair of nodes
+	Links      func(from, to int) Link //if set, replaces Link for each pair of nodes
+	Processing time.Duration           //time a node takes to handle a message
+	Failing    []int                   //index in the roster of the nodes that never respond
+	ColdCache  bool                    //the nodes fetch the public keys from their parent, having none cached
+
+	ProtocolTimeout  time.Duration
+	SubleaderTimeout time.Duration
+	LeavesTimeout    time.Duration
+}
+
+// Result holds the outcome of a simulated run. All durations are in virtual time.
+type Result struct {
+	Signature    []byte
+	Publics      []abstract.Point //public keys in roster order, as used in the mask
+	Duration     time.Duration    //until the signature is produced
+	Disseminated time.Duration    //until the last node received the announcement
+	Stats        protocol.RoundStats
+
+	Messages int
+	Bytes    int
+	Lost     int
+	Events   int
+}
+
+// Simulator holds the state of a simulated run.
+type Simulator struct {
+	config Config
+	suite  abstract.Suite
+	rand   *rand.Rand
+	stream cipher.Stream
+
+	roster   *onet.Roster
+	privates []abstract.Scalar
+	publics  []abstract.Point
+	index    map[network.ServerIdentityID]int
+	failing  []bool
+
+	now     time.Duration
+	queue   eventQueue
+	seq     uint64
+	uplinks []time.Duration //time at which the uplink of each node is free
+	cpus    []time.Duration //time at which each node is done handling its messages
+
+	root         *root
+	participants map[participantKey]*participant
+	instances    int
+	cached       []bool //nodes holding the public keys of the announcement
+	result       *Result
+	err          error
+}
+
+// New creates the nodes of a simulation and checks its configuration.
+func New(config Config) (*Simulator, error) {
+	if config.Hosts < 1 {
+		return nil, fmt.Errorf("the number of hosts cannot be less than one, but is %d", config.Hosts)
+	}
+	if config.Proposal == nil {
+		return nil, errors.New("no proposal specified")
+	}
+	if config.NSubtrees < 1 {
+		config.NSubtrees = 1
+	}
+	if config.ProtocolTimeout < 10 {
+		config.ProtocolTimeout = protocol.DefaultProtocolTimeout
+	}
+	if config.SubleaderTimeout < 10 {
+		config.SubleaderTimeout = protocol.DefaultSubleaderTimeout
+	}
+	if config.LeavesTimeout < 10 {
+		config.LeavesTimeout = protocol.DefaultLeavesTimeout
+	}
+
+	s := &Simulator{
+		config:       config,
+		suite:        network.Suite,
+		rand:         rand.New(rand.NewSource(config.Seed)),
+		stream:       newStream(config.Seed),
+		privates:     make([]abstract.Scalar, config.Hosts),
+		publics:      make([]abstract.Point, config.Hosts),
+		index:        make(map[network.ServerIdentityID]int, config.Hosts),
+		failing:      make([]bool, config.Hosts),
+		uplinks:      make([]time.Duration, config.Hosts),
+		cpus:         make([]time.Duration, config.Hosts),
+		participants: make(map[participantKey]*participant),
+		cached:       make([]bool, config.Hosts),
+	}
+
+	for _, i := range config.Failing {
+		if i == 0 {
+			return nil, errors.New("the root cannot fail")
+		} else if i < 0 || i >= config.Hosts {
+			return nil, fmt.Errorf("failing node %d is not in the roster", i)
+		}
+		s.failing[i] = true
+	}
+
+	//generate the nodes
+	servers := make([]*network.ServerIdentity, config.Hosts)
+	for i := range servers {
+		s.privates[i] = s.suite.Scalar().Pick(s.stream)
+		s.publics[i] = s.suite.Point().Mul(nil, s.privates[i])
+		servers[i] = network.NewServerIdentity(s.publics[i],
+			network.NewTCPAddress(fmt.Sprintf("127.0.0.1:%d", 2000+2*i)))
+		s.index[servers[i].ID] = i
+	}
+	s.roster = onet.NewRoster(servers)
+
+	return s, nil
+}
+
+// Run simulates one round of the protocol and returns its outcome,
+// or an error if the root didn't manage to produce a signature.
+// A simulator can only be run once.
+func (s *Simulator) Run() (*Result, error) {
+	if s.result != nil {
+		return nil, errors.New("the simulator has already been run")
+	}
+	s.result = &Result{Publics: s.publics}
+
+	err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	for s.queue.Len() > 0 && s.err == nil && s.result.Signature == nil {
+		e := heap.Pop(&s.queue).(*event)
+		s.now = e.at
+		s.result.Events++
+		e.fn()
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.result.Signature == nil {
+		return nil, errors.New("the protocol stopped without producing a signature")
+	}
+	s.result.Duration = s.now
+	return s.result, nil
+}
+
+// newStream returns a cipher stream generating the same bytes for the same seed.
+func newStream(seed int64) cipher.Stream {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(seed))
+	key := sha256.Sum256(buf)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err) //cannot happen with a 32 bytes key
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize))
+}
@@ -0,0 +1,230 @@
+package simulator
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dedis/student_17_bftcosi/cosi"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Tests various trees configurations
+func TestSimulator(t *testing.T) {
+	nodes := []int{1, 2, 5, 13, 24, 100}
+	subtrees := []int{1, 2, 5, 9}
+	proposal := []byte{0xFF}
+
+	for _, nNodes := range nodes {
+		for _, nSubtrees := range subtrees {
+			s, err := New(Config{Hosts: nNodes, NSubtrees: nSubtrees, Proposal: proposal,
+				Link: Link{Latency: 10 * time.Millisecond}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := s.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cosi.Verify(network.Suite, result.Publics, proposal, result.Signature, cosi.CompletePolicy{})
+			if err != nil {
+				t.Fatal("didn't get a valid signature with", nNodes, "nodes and", nSubtrees, "subtrees:", err)
+			}
+
+			//each phase crosses two links down and two links up, or one if there are no leaves
+			expected := 8 * 10 * time.Millisecond
+			if nNodes == 1 {
+				expected = 0
+			} else if nNodes-1 <= nSubtrees {
+				expected = 4 * 10 * time.Millisecond
+			}
+			if result.Duration != expected {
+				t.Fatal("expected the round to last", expected, "but lasted", result.Duration)
+			}
+		}
+	}
+}
+
+// Tests that two runs with the same seed give the same result
+func TestSimulatorDeterministic(t *testing.T) {
+	config := Config{Hosts: 50, NSubtrees: 5, Proposal: []byte{0xFF}, Seed: 42,
+		Link:          Link{Latency: 10 * time.Millisecond, Bandwidth: 1000000, Loss: 0.002},
+		LeavesTimeout: 100 * time.Millisecond, SubleaderTimeout: 200 * time.Millisecond,
+		ProtocolTimeout: 10 * time.Second}
+
+	var results []*Result
+	var errs []error
+	for i := 0; i < 2; i++ {
+		s, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.Run()
+		results = append(results, result)
+		errs = append(errs, err)
+	}
+
+	//a lost response makes the round fail, in which case both runs must fail
+	if (errs[0] == nil) != (errs[1] == nil) {
+		t.Fatal("only one of the runs failed with the same seed:", errs)
+	} else if errs[0] != nil {
+		return
+	}
+	if !bytes.Equal(results[0].Signature, results[1].Signature) {
+		t.Fatal("the signatures differ with the same seed")
+	}
+	if results[0].Duration != results[1].Duration || results[0].Lost != results[1].Lost ||
+		results[0].Events != results[1].Events {
+		t.Fatal("the runs differ with the same seed")
+	}
+}
+
+// Tests that failing subleaders are replaced and failing leaves ignored
+func TestSimulatorFailures(t *testing.T) {
+	proposal := []byte{0xFF}
+	s, err := New(Config{Hosts: 24, NSubtrees: 3, Proposal: proposal,
+		Link:    Link{Latency: 10 * time.Millisecond},
+		Failing: []int{1, 2, 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Stats.SubleaderRestarts != 2 {
+		t.Fatal("expected 2 subleader restarts, but got", result.Stats.SubleaderRestarts)
+	}
+	err = cosi.Verify(network.Suite, result.Publics, proposal, result.Signature, cosi.ThresholdPolicy{T: 21})
+	if err != nil {
+		t.Fatal("didn't get a valid signature:", err)
+	}
+	err = cosi.Verify(network.Suite, result.Publics, proposal, result.Signature, cosi.ThresholdPolicy{T: 22})
+	if err == nil {
+		t.Fatal("the failing nodes should not be in the signature")
+	}
+}
+
+// Tests that a limited bandwidth slows down the dissemination of large proposals
+func TestSimulatorBandwidth(t *testing.T) {
+	var durations []time.Duration
+	for _, bandwidth := range []int{0, 10000000} {
+		s, err := New(Config{Hosts: 100, NSubtrees: 10, Proposal: make([]byte, 1000000),
+			Link: Link{Latency: 10 * time.Millisecond, Bandwidth: bandwidth}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		durations = append(durations, result.Disseminated)
+	}
+
+	//the root sends ten 1MB announcements at 10MB/s, then the last subleader nine
+	if durations[1]-durations[0] < 1500*time.Millisecond {
+		t.Fatal("expected a slower dissemination with limited bandwidth, but took", durations[1],
+			"instead of", durations[0])
+	}
+}
+
+func TestSimulatorErrors(t *testing.T) {
+	_, err := New(Config{Hosts: 0, Proposal: []byte{0xFF}})
+	if err == nil {
+		t.Fatal("should not accept zero hosts")
+	}
+	_, err = New(Config{Hosts: 10})
+	if err == nil {
+		t.Fatal("should not accept a nil proposal")
+	}
+	_, err = New(Config{Hosts: 10, Proposal: []byte{0xFF}, Failing: []int{0}})
+	if err == nil {
+		t.Fatal("should not accept a failing root")
+	}
+
+	//every message lost, the root signs alone after trying every subleader
+	proposal := []byte{0xFF}
+	s, err := New(Config{Hosts: 10, Proposal: proposal, Link: Link{Loss: 1},
+		SubleaderTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stats.SubleaderRestarts != 9 {
+		t.Fatal("expected 9 subleader restarts, but got", result.Stats.SubleaderRestarts)
+	}
+	err = cosi.Verify(network.Suite, result.Publics, proposal, result.Signature, cosi.ThresholdPolicy{T: 2})
+	if err == nil {
+		t.Fatal("only the root should be in the signature")
+	}
+
+	//every message lost, and not enough time to try every subleader
+	s, err = New(Config{Hosts: 10, Proposal: proposal, Link: Link{Loss: 1},
+		SubleaderTimeout: 100 * time.Millisecond, ProtocolTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Run()
+	if err == nil {
+		t.Fatal("should not produce a signature when the commitments don't come in time")
+	}
+}
+
+// Tests a simulation of ten thousand nodes
+func TestSimulatorLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large simulation in short mode")
+	}
+	proposal := []byte{0xFF}
+	s, err := New(Config{Hosts: 10000, NSubtrees: 100, Proposal: proposal,
+		Link:          Link{Latency: 50 * time.Millisecond, Bandwidth: 10000000},
+		LeavesTimeout: 10 * time.Second, SubleaderTimeout: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cosi.Verify(network.Suite, result.Publics, proposal, result.Signature, cosi.CompletePolicy{})
+	if err != nil {
+		t.Fatal("didn't get a valid signature:", err)
+	}
+}
+
+// Tests that referencing the public keys by their hash saves most of the bytes
+// of the announcements, even when every node has to fetch them once
+func TestSimulatorPublicsCache(t *testing.T) {
+	proposal := []byte{0xFF}
+	hosts := 1000
+	var sent []int
+	for _, cold := range []bool{false, true} {
+		s, err := New(Config{Hosts: hosts, NSubtrees: 30, Proposal: proposal, ColdCache: cold,
+			Link: Link{Latency: 10 * time.Millisecond}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cosi.Verify(network.Suite, result.Publics, proposal, result.Signature, cosi.CompletePolicy{})
+		if err != nil {
+			t.Fatal("didn't get a valid signature:", err)
+		}
+		sent = append(sent, result.Bytes)
+	}
+
+	//the public keys cross each link once with a cold cache, and never with a warm one
+	keys := (hosts - 1) * pointSize * hosts
+	if sent[1]-sent[0] < keys {
+		t.Fatal("expected the cold cache to send at least", keys, "more bytes, but sent", sent[1]-sent[0])
+	}
+	if sent[0] > keys/10 {
+		t.Fatal("expected the announcements to be much smaller than the public keys, but sent", sent[0], "bytes")
+	}
+}